@@ -15,28 +15,210 @@
 package mongodbadapter
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	neturl "net/url"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const defaultTimeout time.Duration = 30 * time.Second
 const defaultDatabaseName string = "casbin"
 const defaultCollectionName string = "casbin_rule"
+const defaultAppName string = "casbin-mongodb-adapter"
+
+// csvBatchSize is the number of rules SaveFromCSVStream inserts at once.
+const csvBatchSize = 1000
+
+// defaultMaxRetries is the number of times a failed write is retried.
+const defaultMaxRetries = 3
+
+// retryBaseDelay and retryMaxDelay bound the backoff between write retries.
+const (
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// maxDocumentSize is the maximum size of a BSON document stored by MongoDB.
+const maxDocumentSize = 16 * 1024 * 1024
+
+// maxIndexKeySize is the maximum size of an index key of MongoDB before 4.2,
+// and the default maximum size of the key of a rule in the unique index.
+const maxIndexKeySize = 1024
+
+// EmptyValue is a field value for RemoveFilteredPolicy and
+// UpdateFilteredPolicies that matches only the rules whose value is empty,
+// whereas an empty string matches any value. Casbin models don't know it, so
+// pass it to the adapter directly, then reload the policy.
+const EmptyValue = "\x00"
+
+// ErrDocumentTooLarge is returned when AdapterConfig.CheckDocumentSize is
+// enabled and a rule would exceed the maximum BSON document size.
+var ErrDocumentTooLarge = errors.New("rule exceeds the maximum BSON document size")
+
+// ErrDatabaseNotFound is returned when AdapterConfig.RequireExistingDatabase
+// is enabled and the configured database doesn't exist.
+var ErrDatabaseNotFound = errors.New("database not found")
+
+// ErrQuotaExceeded is returned by AddPolicyWithQuota when the subject already
+// has the maximum number of rules.
+var ErrQuotaExceeded = errors.New("rule quota exceeded")
+
+// ErrPolicyTooLarge is returned by LoadPolicyCapped when a ptype has more
+// rules than allowed.
+var ErrPolicyTooLarge = errors.New("policy too large")
+
+// ErrMaintenanceMode is returned by the methods writing the policy while the
+// adapter is in maintenance mode. See SetMaintenanceMode.
+var ErrMaintenanceMode = errors.New("adapter is in maintenance mode")
+
+// ErrIndexMismatch is returned by VerifyIndexes when an index maintained by
+// the adapter is missing or differs from the configuration.
+var ErrIndexMismatch = errors.New("index mismatch")
+
+// ErrInconsistentArity is returned by LoadPolicy and LoadFilteredPolicy with
+// AdapterConfig.ValidateOnLoad when the loaded rules of a ptype don't all
+// have the same number of values.
+var ErrInconsistentArity = errors.New("inconsistent rule arity")
+
+// ErrPolicyNotFound is returned by RemovePolicyStrict when the storage has no
+// rule to remove.
+var ErrPolicyNotFound = errors.New("policy not found")
+
+// ErrFilteredSavePolicy is returned by SavePolicy and DiffAgainstModel when
+// the loaded policy is filtered, since saving it would drop the rules that
+// weren't loaded. See ForceSavePolicy.
+var ErrFilteredSavePolicy = errors.New("cannot save a filtered policy")
+
+// ErrTooManyArguments is returned by the URL constructors when they are
+// passed more than one timeout.
+var ErrTooManyArguments = errors.New("too many arguments")
+
+// ErrLengthMismatch is returned when two slices passed together, e.g. the old
+// and new rules of UpdatePolicies, have different lengths.
+var ErrLengthMismatch = errors.New("length mismatch")
+
+// ErrValueTooLong is returned by the methods writing rules when a value
+// exceeds AdapterConfig.MaxValueLength, or, by default, when the values of a
+// rule exceed the index key limit of MongoDB in the unique index.
+var ErrValueTooLong = errors.New("rule value too long")
+
+// BulkWriteError is returned by AddPoliciesWithOptions in unordered mode when
+// some rules weren't inserted. It lists the rules as they were passed.
+type BulkWriteError struct {
+	// Inserted are the rules inserted.
+	Inserted [][]string
+	// Duplicates are the rules not inserted because they were already stored.
+	Duplicates [][]string
+	// Failed are the rules not inserted for another reason.
+	Failed [][]string
+	// Err is the error of the first failed rule, if any.
+	Err error
+}
+
+func (e *BulkWriteError) Error() string {
+	total := len(e.Inserted) + len(e.Duplicates) + len(e.Failed)
+	msg := fmt.Sprintf("%d of %d rules inserted, %d already stored, %d failed", len(e.Inserted), total, len(e.Duplicates), len(e.Failed))
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BulkWriteError) Unwrap() error {
+	return e.Err
+}
+
+// CollectionAdapter is implemented by the adapters returned by the
+// constructors of this package. It gives access to the underlying collection
+// for queries the adapter doesn't provide, e.g. aggregations:
+//
+//	collection := a.(mongodbadapter.CollectionAdapter).Collection()
+//
+// Writes through the collection bypass the model cached by Casbin, which
+// won't see them until the policy is reloaded.
+type CollectionAdapter interface {
+	Collection() *mongo.Collection
+}
+
+// Observer is notified of every operation of the adapter, e.g. to export
+// latency histograms and error counters.
+type Observer interface {
+	// ObserveOp is called when the op method returns, with its duration and
+	// the error it returned, if any. The methods taking a context report the
+	// name of their counterpart without it, e.g. "LoadPolicy" for
+	// LoadPolicyCtx. It may be called concurrently.
+	ObserveOp(op string, duration time.Duration, err error)
+}
+
+// BSONType is the BSON type a value of the rules is stored with.
+type BSONType int
+
+const (
+	// BSONString stores the value as a string. It's the default.
+	BSONString BSONType = iota
+	// BSONInt64 stores the value as a 64-bit integer.
+	BSONInt64
+	// BSONDouble stores the value as a double.
+	BSONDouble
+	// BSONBool stores the value as a boolean.
+	BSONBool
+)
+
+// ConflictResolution determines how SavePolicy handles rules of the model that
+// collide with each other under the unique index.
+type ConflictResolution int
+
+const (
+	// ConflictError makes SavePolicy fail with the duplicate key error.
+	ConflictError ConflictResolution = iota
+	// ConflictKeepFirst saves the first of the colliding rules and skips the
+	// others.
+	ConflictKeepFirst
+	// ConflictMerge merges the colliding rules into a single document holding
+	// the last of them.
+	ConflictMerge
+)
 
 // CasbinRule represents a rule in Casbin.
 type CasbinRule struct {
+	// ID is the _id of the stored rule. It is only set on the rules read
+	// from the collection, or derived from the rule with
+	// AdapterConfig.DeterministicID.
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+	// Sec is the section of the rule. It is only set when
+	// AdapterConfig.StoreSection is enabled.
+	Sec   string `bson:"sec,omitempty"`
 	PType string
 	V0    string
 	V1    string
@@ -44,29 +226,600 @@ type CasbinRule struct {
 	V3    string
 	V4    string
 	V5    string
+	// Order is the insertion sequence number of the rule. It is only set
+	// when AdapterConfig.PreserveOrder is enabled.
+	Order int64 `bson:"order,omitempty"`
+	// ExpiresAt is the expiry parsed from the value at
+	// AdapterConfig.ExpiryFieldIndex, if any. The rule is removed once
+	// expired.
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty"`
+	// CreatedAt and UpdatedAt are the times the rule was added and last
+	// updated. They are only set when AdapterConfig.Timestamps is enabled,
+	// and aren't part of the rule loaded into the model.
+	CreatedAt *time.Time `bson:"createdAt,omitempty"`
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty"`
+	// Extra holds the values past V5, stored as v6, v7, and so on.
+	Extra []string `bson:"-"`
+
+	// types holds the BSON types the values are stored with, by index.
+	types map[int]BSONType
+	// names holds the configured names of the fields, if any.
+	names *fieldNames
+	// longValues is the length past which a value is stored apart, or 0.
+	longValues int
+}
+
+// longValueSuffix is appended to the name of a value field to name the field
+// storing a long value apart.
+const longValueSuffix = "_long"
+
+// longValuePlaceholder returns the placeholder stored, and indexed, instead
+// of a long value.
+func longValuePlaceholder(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fieldNames maps the default field names of the rules ("ptype", "v0", ...)
+// to the configured ones, and back.
+type fieldNames struct {
+	stored map[string]string
+	loaded map[string]string
+}
+
+// newFieldNames returns the mapping of the configured field names, or nil if
+// none is configured. The first name replaces "ptype", the next ones "v0",
+// "v1", and so on.
+func newFieldNames(names []string) (*fieldNames, error) {
+	n := &fieldNames{
+		stored: make(map[string]string),
+		loaded: make(map[string]string),
+	}
+	for i, name := range names {
+		field := "ptype"
+		if i > 0 {
+			field = fmt.Sprintf("v%d", i-1)
+		}
+		if name == "" || name == field {
+			continue
+		}
+		if _, ok := n.loaded[name]; ok {
+			return nil, fmt.Errorf("duplicate field name %q", name)
+		}
+		if _, ok := valueIndex(name); ok || name == "ptype" || name == "_id" || name == "sec" || name == "order" {
+			return nil, fmt.Errorf("field name %q is reserved", name)
+		}
+		n.stored[field] = name
+		n.loaded[name] = field
+	}
+	if len(n.stored) == 0 {
+		return nil, nil
+	}
+	return n, nil
+}
+
+// field returns the name the field is stored with.
+func (n *fieldNames) field(name string) string {
+	if n == nil {
+		return name
+	}
+	if stored, ok := n.stored[name]; ok {
+		return stored
+	}
+	return name
+}
+
+// rename returns the document with its top-level keys renamed by names.
+func rename(doc []byte, names map[string]string) ([]byte, error) {
+	elements, err := bson.Raw(doc).Elements()
+	if err != nil {
+		return nil, err
+	}
+	index, dst := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		key := element.Key()
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		value := element.Value()
+		dst = bsoncore.AppendValueElement(dst, key, bsoncore.Value{Type: value.Type, Data: value.Value})
+	}
+	return bsoncore.AppendDocumentEnd(dst, index)
+}
+
+// MarshalBSON stores the fields of the rule, followed by its Extra values.
+// The values are stored with their configured BSON types and field names.
+func (c CasbinRule) MarshalBSON() ([]byte, error) {
+	doc, err := c.marshalValues()
+	if err != nil || c.names == nil {
+		return doc, err
+	}
+	return rename(doc, c.names.stored)
+}
+
+// marshalValues stores the fields of the rule under their default names.
+func (c CasbinRule) marshalValues() ([]byte, error) {
+	type rule CasbinRule
+	doc, err := bson.Marshal(rule(c))
+	if err != nil || (len(c.Extra) == 0 && len(c.types) == 0 && c.longValues == 0) {
+		return doc, err
+	}
+
+	elements, err := bson.Raw(doc).Elements()
+	if err != nil {
+		return nil, err
+	}
+	index, dst := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		key := element.Key()
+		if n, ok := valueIndex(key); ok {
+			if dst, err = c.appendValue(dst, key, n, element.Value().StringValue()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dst = append(dst, element...)
+	}
+	for i, value := range c.Extra {
+		key := fmt.Sprintf("v%d", i+6)
+		if dst, err = c.appendValue(dst, key, i+6, value); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.AppendDocumentEnd(dst, index)
+}
+
+// appendValue appends the value at index n under key, converted to its BSON
+// type. A long value is appended under key with the longValueSuffix, after
+// its placeholder under key.
+func (c CasbinRule) appendValue(dst []byte, key string, n int, value string) ([]byte, error) {
+	if c.longValues > 0 && len(value) > c.longValues {
+		dst = bsoncore.AppendStringElement(dst, key, longValuePlaceholder(value))
+		return bsoncore.AppendStringElement(dst, key+longValueSuffix, value), nil
+	}
+	return appendValue(dst, key, c.types[n], value)
+}
+
+// UnmarshalBSON loads the fields of the rule, collecting the values past v5
+// into Extra. Values stored with another BSON type than string are converted
+// back to strings, e.g. the double 1.50 to "1.5".
+func (c *CasbinRule) UnmarshalBSON(data []byte) error {
+	if c.names != nil {
+		var err error
+		if data, err = rename(data, c.names.loaded); err != nil {
+			return err
+		}
+	}
+	elements, err := bson.Raw(data).Elements()
+	if err != nil {
+		return err
+	}
+
+	// The long values replace their placeholders.
+	long := make(map[int]string)
+	for _, element := range elements {
+		key := element.Key()
+		if !strings.HasSuffix(key, longValueSuffix) {
+			continue
+		}
+		if n, ok := valueIndex(strings.TrimSuffix(key, longValueSuffix)); ok {
+			long[n], _ = element.Value().StringValueOK()
+		}
+	}
+
+	var extra []string
+	index, doc := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		key := element.Key()
+		n, ok := valueIndex(key)
+		if !ok {
+			doc = append(doc, element...)
+			continue
+		}
+		value, ok := stringValue(element.Value())
+		if !ok {
+			continue
+		}
+		if longValue, isLong := long[n]; isLong {
+			value = longValue
+		}
+		if n < 6 {
+			doc = bsoncore.AppendStringElement(doc, key, value)
+			continue
+		}
+		for len(extra) <= n-6 {
+			extra = append(extra, "")
+		}
+		extra[n-6] = value
+	}
+	doc, err = bsoncore.AppendDocumentEnd(doc, index)
+	if err != nil {
+		return err
+	}
+
+	type rule CasbinRule
+	var r rule
+	if err := bson.Unmarshal(doc, &r); err != nil {
+		return err
+	}
+	r.Extra = extra
+	r.types = c.types
+	r.names = c.names
+	*c = CasbinRule(r)
+	return nil
+}
+
+// selector returns the line without the fields that are set when the rule is
+// written, to match the stored rule.
+func (c CasbinRule) selector() CasbinRule {
+	c.Order = 0
+	c.ExpiresAt = nil
+	c.CreatedAt = nil
+	c.UpdatedAt = nil
+	return c
+}
+
+// valueIndex returns the index of the value stored under key, e.g. 3 for "v3".
+func valueIndex(key string) (int, bool) {
+	if !strings.HasPrefix(key, "v") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(key[1:])
+	return n, err == nil && n >= 0
+}
+
+// appendValue appends the value under key to dst, converted to the BSON type.
+// Empty values are always stored as strings.
+func appendValue(dst []byte, key string, t BSONType, value string) ([]byte, error) {
+	if value == "" {
+		return bsoncore.AppendStringElement(dst, key, value), nil
+	}
+
+	switch t {
+	case BSONInt64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return bsoncore.AppendInt64Element(dst, key, n), nil
+	case BSONDouble:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return bsoncore.AppendDoubleElement(dst, key, f), nil
+	case BSONBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return bsoncore.AppendBooleanElement(dst, key, b), nil
+	}
+	return bsoncore.AppendStringElement(dst, key, value), nil
+}
+
+// stringValue returns the value converted to a string, if it's of a type
+// BSONType can store.
+func stringValue(value bson.RawValue) (string, bool) {
+	switch value.Type {
+	case bsontype.String:
+		return value.StringValue(), true
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10), true
+	case bsontype.Int64:
+		return strconv.FormatInt(value.Int64(), 10), true
+	case bsontype.Double:
+		return strconv.FormatFloat(value.Double(), 'g', -1, 64), true
+	case bsontype.Boolean:
+		return strconv.FormatBool(value.Boolean()), true
+	}
+	return "", false
 }
 
 // adapter represents the MongoDB adapter for policy storage.
 type adapter struct {
 	client     *mongo.Client
 	collection *mongo.Collection
-	timeout    time.Duration
-	filtered   bool
+	// shards holds the collections the rules are distributed over with
+	// ShardCount, the first one being collection.
+	shards []*mongo.Collection
+	// collectionOption holds the options of the collections, if any.
+	collectionOption *options.CollectionOptions
+	// loadReadPref is the read preference of the loads, if not nil.
+	loadReadPref *readpref.ReadPref
+	// pendingIndexes is set until the indexes of a collection selected with
+	// WithCollection are created by its first write.
+	pendingIndexes atomic.Bool
+	// timeout is the time.Duration bounding every operation.
+	timeout  atomic.Int64
+	filtered bool
+	// saveTimeout, if not zero, bounds the bulk writes instead of timeout.
+	saveTimeout time.Duration
+	// ownsClient is set if the adapter connected the client itself, and is
+	// responsible for disconnecting it.
+	ownsClient bool
+	// closed is set once the client has been disconnected, by Close or the
+	// finalizer, whichever comes first.
+	closed atomic.Bool
+	// ctx is the parent of every context the adapter derives internally.
+	ctx context.Context
+	// checkDocumentSize rejects rules exceeding maxDocumentSize before they
+	// are sent to the server.
+	checkDocumentSize bool
+	// saveConflict determines how SavePolicy handles colliding rules.
+	saveConflict ConflictResolution
+	// versioning increments the policy generation on every write.
+	versioning bool
+	// wrapErrors annotates the returned errors with the adapter method and
+	// the MongoDB command that failed.
+	wrapErrors bool
+	// orderedRemove stops RemovePolicies at the first failed removal.
+	orderedRemove bool
+	// truncateCapped skips the rules past the cap in LoadPolicyCapped.
+	truncateCapped bool
+	// storeSection stores and matches the section of every rule.
+	storeSection bool
+	// valueColumns is the number of value columns every rule is stored with.
+	valueColumns int
+	// uniqueIndex makes the index over the rule fields unique.
+	uniqueIndex bool
+	// indexKeys, if not nil, are the fields of the index over the rules.
+	indexKeys []string
+	// trimOnLoad trims the values of the rules loaded into a model.
+	trimOnLoad bool
+	// preSaveValidate validates the rules before SavePolicy writes them.
+	preSaveValidate func(rules []CasbinRule) error
+	// loadRetries is the number of times a failed load starts over.
+	loadRetries int
+	// batchSize is the cursor batch size of the loads, if positive.
+	batchSize int32
+	// validateOnLoad checks the arity of the loaded rules.
+	validateOnLoad bool
+	// softDelete marks the removed rules deleted instead of deleting them.
+	softDelete bool
+	// timestamps stores the creation and update times of the rules.
+	timestamps bool
+	// causalConsistency runs every operation in a causally consistent session.
+	causalConsistency bool
+	// clock tracks the latest operation time for causal consistency.
+	clock causalClock
+	// fieldTypes holds the BSON types the values are stored with, by index.
+	fieldTypes map[int]BSONType
+	// fieldNames holds the configured names of the fields, if any.
+	fieldNames *fieldNames
+	// loadConcurrency bounds the collections read at once.
+	loadConcurrency int
+	// loadWorkers is the number of goroutines decoding the loaded rules.
+	loadWorkers int
+	// preserveOrder assigns an insertion sequence number to every new rule
+	// and loads rules in that order.
+	preserveOrder bool
+	// stableOrder loads rules sorted by their fields.
+	stableOrder bool
+	// maintenance rejects the writes of the application. It's shared with
+	// the views of WithCollection.
+	maintenance *atomic.Bool
+	// maxRetries is the number of times a write failing with a transient
+	// error is retried.
+	maxRetries int
+	// maxValueLength is the maximum length of the written values, if
+	// positive.
+	maxValueLength int
+	// checkKeySize checks that the written rules fit in the unique index.
+	checkKeySize bool
+	// expiryFieldIndex is the index of the value holding the expiry of the
+	// rules, or 0 if they don't expire.
+	expiryFieldIndex int
+	// skipIndexCreation leaves the creation of the indexes to the operators.
+	skipIndexCreation bool
+	// observer, if not nil, is notified of every operation.
+	observer Observer
+	// tracer, if not nil, starts the spans of the operations.
+	tracer trace.Tracer
+	// onDecodeError, if not nil, decides whether a load skips a malformed
+	// document.
+	onDecodeError func(raw bson.Raw, err error) error
+	// deterministicID derives the _id of the rules from their values.
+	deterministicID bool
+	// longValues is the length past which values are stored apart.
+	longValues int
+}
+
+// baseContext returns the parent of every context the adapter derives.
+func (a *adapter) baseContext() context.Context {
+	if a.ctx != nil {
+		return a.ctx
+	}
+	return context.Background()
+}
+
+// withTimeout derives a context bounded by the adapter timeout from ctx,
+// unless ctx already has a deadline.
+func (a *adapter) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return a.withSession(context.WithCancel(ctx))
+	}
+	return a.timeoutContext(ctx)
+}
+
+// timeoutContext derives a context bounded by the adapter timeout from ctx.
+func (a *adapter) timeoutContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return a.withSession(context.WithTimeout(ctx, time.Duration(a.timeout.Load())))
+}
+
+// saveContext is like withTimeout, but bounds ctx by the save timeout, if
+// configured.
+func (a *adapter) saveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || a.saveTimeout == 0 {
+		return a.withTimeout(ctx)
+	}
+	return a.withSession(context.WithTimeout(ctx, a.saveTimeout))
+}
+
+// SetTimeout sets the timeout of the operations started afterwards. It's
+// safe to call concurrently with the other methods.
+func (a *adapter) SetTimeout(timeout time.Duration) {
+	a.timeout.Store(int64(timeout))
+}
+
+// withSession attaches a causally consistent session to ctx, if causal
+// consistency is enabled and ctx doesn't have a session yet. The session is
+// advanced to the latest operation of the adapter, and ended by cancel.
+func (a *adapter) withSession(ctx context.Context, cancel context.CancelFunc) (context.Context, context.CancelFunc) {
+	if !a.causalConsistency || mongo.SessionFromContext(ctx) != nil {
+		return ctx, cancel
+	}
+
+	session, err := a.client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		// The operation will fail with the same error without a session.
+		return ctx, cancel
+	}
+	a.clock.advance(session)
+
+	return mongo.NewSessionContext(ctx, session), func() {
+		a.clock.observe(session)
+		session.EndSession(context.Background())
+		cancel()
+	}
+}
+
+// causalClock tracks the operation time of the latest operation of an adapter,
+// to make every session of the adapter observe it.
+type causalClock struct {
+	mu            sync.Mutex
+	operationTime *primitive.Timestamp
+}
+
+// advance advances the operation time of the session to the latest one.
+func (c *causalClock) advance(session mongo.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.operationTime != nil {
+		_ = session.AdvanceOperationTime(c.operationTime)
+	}
+}
+
+// observe records the operation time of the session, if it's the latest one.
+func (c *causalClock) observe(session mongo.Session) {
+	t := session.OperationTime()
+	if t == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.operationTime == nil || t.T > c.operationTime.T || (t.T == c.operationTime.T && t.I > c.operationTime.I) {
+		c.operationTime = t
+	}
+}
+
+// observe returns a function notifying the observer of the op method, which
+// returns *err, with the time elapsed since observe was called. It is meant
+// to be deferred: defer a.observe("LoadPolicy", &err)().
+func (a *adapter) observe(op string, err *error) func() {
+	if a.observer == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		a.observer.ObserveOp(op, time.Since(start), *err)
+	}
+}
+
+// tracerName is the name of the tracer obtained from
+// AdapterConfig.TracerProvider.
+const tracerName = "github.com/casbin/mongodb-adapter/v3"
+
+// noopTracer starts the spans when no tracer provider is configured.
+var noopTracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+
+// startSpan starts the span of the op method as a child of the span of ctx,
+// and returns it with a context holding it.
+func (a *adapter) startSpan(ctx context.Context, op string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := a.tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+	return tracer.Start(ctx, "mongodb-adapter/"+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// endSpan records *err in the span and ends it. It is meant to be deferred.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// ptypeAttribute returns the span attribute of the ptype of the rules.
+func ptypeAttribute(ptype string) attribute.KeyValue {
+	return attribute.String("casbin.ptype", ptype)
+}
+
+// rulesAttribute returns the span attribute of the number of rules.
+func rulesAttribute(n int) attribute.KeyValue {
+	return attribute.Int("casbin.rules", n)
+}
+
+// wrapError prefixes *err with the adapter method that returned it, if error
+// wrapping is enabled. It is meant to be deferred.
+func (a *adapter) wrapError(method string, err *error) {
+	if a.wrapErrors && *err != nil {
+		*err = fmt.Errorf("mongodbadapter: %s: %w", method, *err)
+	}
+}
+
+// commandError annotates err with the MongoDB command that failed and the
+// namespace it ran on, if error wrapping is enabled.
+func (a *adapter) commandError(command string, collection *mongo.Collection, err error) error {
+	if !a.wrapErrors || err == nil {
+		return err
+	}
+
+	preposition := "on"
+	switch command {
+	case "insert":
+		preposition = "into"
+	case "delete":
+		preposition = "from"
+	case "find", "update", "count":
+		preposition = "in"
+	}
+	return fmt.Errorf("%s %s %s.%s: %w", command, preposition, collection.Database().Name(), collection.Name(), err)
 }
 
 // finalizer is the destructor for adapter.
 func finalizer(a *adapter) {
-	a.close()
+	_ = a.close()
 }
 
 // NewAdapter is the constructor for Adapter. If database name is not provided
-// in the Mongo URL, 'casbin' will be used as database name.
-// 'casbin_rule' will be used as a collection name.
+// in the Mongo URL, 'casbin' will be used as database name, unless a
+// DefaultDatabaseName option names another one.
+// 'casbin_rule' will be used as a collection name, unless the URL names one
+// after the database, separated by a dot or a slash, as in
+// "mongodb://localhost:27017/mydb.mycoll" or
+// "mongodb://localhost:27017/mydb/mycoll". The optional timeout is a
+// time.Duration, or an int or int64 number of seconds.
 func NewAdapter(url string, timeout ...interface{}) (persist.BatchAdapter, error) {
 	if !strings.HasPrefix(url, "mongodb+srv://") && !strings.HasPrefix(url, "mongodb://") {
 		url = fmt.Sprint("mongodb://" + url)
 	}
 
+	// The collection isn't part of the URL the driver expects, e.g. as the
+	// default authentication database.
+	url, collectionName, err := splitCollection(url)
+	if err != nil {
+		return nil, err
+	}
+	if collectionName == "" {
+		collectionName = defaultCollectionName
+	}
+
 	// Parse and validate url before apply it.
 	connString, err := connstring.ParseAndValidate(url)
 
@@ -74,17 +827,48 @@ func NewAdapter(url string, timeout ...interface{}) (persist.BatchAdapter, error
 		return nil, err
 	}
 
-	clientOption := options.Client().ApplyURI(url)
+	clientOption := urlClientOption(url)
 
-	var databaseName string
-	// Get database name from connString.
-	if connString.Database != "" {
-		databaseName = connString.Database
-	} else {
-		databaseName = defaultDatabaseName
+	// Get database name from connString, or from the options if empty.
+	return baseNewAdapter(clientOption, connString.Database, collectionName, timeout...)
+}
+
+// urlClientOption returns the client options of the Mongo URL, with the
+// default app name unless the URL sets one with the appName option.
+func urlClientOption(uri string) *options.ClientOptions {
+	clientOption := options.Client().ApplyURI(uri)
+	if clientOption.AppName == nil {
+		clientOption.SetAppName(defaultAppName)
 	}
+	return clientOption
+}
 
-	return baseNewAdapter(clientOption, databaseName, defaultCollectionName, timeout...)
+// splitCollection returns the URL without the collection named after the
+// database in its path, and the collection, or "" if the URL doesn't name one.
+func splitCollection(uri string) (string, string, error) {
+	// The hosts, and the credentials, can't contain an unescaped slash.
+	start := strings.Index(uri, "://") + len("://")
+	slash := strings.IndexByte(uri[start:], '/')
+	if slash < 0 {
+		return uri, "", nil
+	}
+	pathStart := start + slash + 1
+	pathEnd := len(uri)
+	if i := strings.IndexByte(uri[pathStart:], '?'); i >= 0 {
+		pathEnd = pathStart + i
+	}
+
+	// A database name can't contain a dot or a slash.
+	path := uri[pathStart:pathEnd]
+	sep := strings.IndexAny(path, "./")
+	if sep < 0 {
+		return uri, "", nil
+	}
+	collection, err := neturl.PathUnescape(path[sep+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid collection %q: %w", path[sep+1:], err)
+	}
+	return uri[:pathStart+sep] + uri[pathEnd:], collection, nil
 }
 
 // NewAdapterWithClientOption is an alternative constructor for Adapter
@@ -99,17 +883,83 @@ func NewAdapterWithCollectionName(clientOption *options.ClientOptions, databaseN
 	return baseNewAdapter(clientOption, databaseName, collectionName, timeout...)
 }
 
+// NewAdapterWithTLS is an alternative constructor for Adapter that does the
+// same as NewAdapterWithClientOption, with the client options of the Mongo URL
+// using tlsConfig, e.g. holding a client certificate for X.509 authentication.
+func NewAdapterWithTLS(uri string, databaseName string, tlsConfig *tls.Config, timeout ...interface{}) (persist.BatchAdapter, error) {
+	return baseNewAdapter(tlsClientOption(uri, tlsConfig), databaseName, defaultCollectionName, timeout...)
+}
+
+// tlsClientOption returns the client options of the Mongo URL using tlsConfig.
+func tlsClientOption(uri string, tlsConfig *tls.Config) *options.ClientOptions {
+	if !strings.HasPrefix(uri, "mongodb+srv://") && !strings.HasPrefix(uri, "mongodb://") {
+		uri = "mongodb://" + uri
+	}
+	return urlClientOption(uri).SetTLSConfig(tlsConfig)
+}
+
+// ConstructorOption is an option the URL constructors accept in addition to
+// the timeout, e.g. NewAdapter(url, mongodbadapter.WithoutIndexCreation).
+type ConstructorOption int
+
+const (
+	// WithoutIndexCreation doesn't create the indexes, like
+	// AdapterConfig.SkipIndexCreation.
+	WithoutIndexCreation ConstructorOption = iota + 1
+)
+
+// DefaultDatabaseName is an option the URL constructors accept in addition to
+// the timeout, naming the database used when the URL doesn't name one instead
+// of "casbin", e.g. NewAdapter(url, mongodbadapter.DefaultDatabaseName("casbin_dev")).
+type DefaultDatabaseName string
+
+// AppName is an option the URL constructors accept in addition to the
+// timeout, naming the application in the handshake with the server, shown
+// in its logs and currentOp, e.g. NewAdapter(url, mongodbadapter.AppName("billing")).
+// The adapters created from a URL are named "casbin-mongodb-adapter", unless
+// the URL sets the appName option.
+type AppName string
+
 // baseNewAdapter is a base constructor for Adapter
 func baseNewAdapter(clientOption *options.ClientOptions, databaseName string, collectionName string, timeout ...interface{}) (persist.BatchAdapter, error) {
 	a := &adapter{}
 	a.filtered = false
+	a.uniqueIndex = true
+	a.maintenance = new(atomic.Bool)
+	a.maxRetries = defaultMaxRetries
+	a.checkKeySize = true
 
-	if len(timeout) == 1 {
-		a.timeout = timeout[0].(time.Duration)
-	} else if len(timeout) > 1 {
-		return nil, errors.New("too many arguments")
-	} else {
-		a.timeout = defaultTimeout
+	a.timeout.Store(int64(defaultTimeout))
+	hasTimeout := false
+	for _, arg := range timeout {
+		if option, ok := arg.(ConstructorOption); ok {
+			if option == WithoutIndexCreation {
+				a.skipIndexCreation = true
+			}
+			continue
+		}
+		if name, ok := arg.(DefaultDatabaseName); ok {
+			if databaseName == "" {
+				databaseName = string(name)
+			}
+			continue
+		}
+		if name, ok := arg.(AppName); ok {
+			clientOption = withAppName(clientOption, string(name))
+			continue
+		}
+		if hasTimeout {
+			return nil, ErrTooManyArguments
+		}
+		timeout, err := parseTimeout(arg)
+		if err != nil {
+			return nil, err
+		}
+		a.timeout.Store(int64(timeout))
+		hasTimeout = true
+	}
+	if databaseName == "" {
+		databaseName = defaultDatabaseName
 	}
 
 	// Open the DB, create it if not existed.
@@ -124,6 +974,26 @@ func baseNewAdapter(clientOption *options.ClientOptions, databaseName string, co
 	return a, nil
 }
 
+// withAppName returns a copy of the client options naming the application,
+// leaving the options of the caller, who may reuse them, unchanged.
+func withAppName(clientOption *options.ClientOptions, name string) *options.ClientOptions {
+	return options.MergeClientOptions(clientOption).SetAppName(name)
+}
+
+// parseTimeout returns the timeout passed to a URL constructor: a
+// time.Duration, or an int or int64 number of seconds.
+func parseTimeout(arg interface{}) (time.Duration, error) {
+	switch timeout := arg.(type) {
+	case time.Duration:
+		return timeout, nil
+	case int:
+		return time.Duration(timeout) * time.Second, nil
+	case int64:
+		return time.Duration(timeout) * time.Second, nil
+	}
+	return 0, fmt.Errorf("unsupported timeout type %T, expected a time.Duration or a number of seconds", arg)
+}
+
 // NewFilteredAdapter is the constructor for FilteredAdapter.
 // Casbin will not automatically call LoadPolicy() for a filtered adapter.
 func NewFilteredAdapter(url string) (persist.FilteredAdapter, error) {
@@ -136,13 +1006,330 @@ func NewFilteredAdapter(url string) (persist.FilteredAdapter, error) {
 	return a.(*adapter), nil
 }
 
+// NewFilteredAdapterWithClientOption is the constructor for FilteredAdapter
+// that does the same as NewFilteredAdapter, but uses mongo.ClientOption
+// instead of a Mongo URL + a databaseName option.
+func NewFilteredAdapterWithClientOption(clientOption *options.ClientOptions, databaseName string, timeout ...interface{}) (persist.FilteredAdapter, error) {
+	a, err := baseNewAdapter(clientOption, databaseName, defaultCollectionName, timeout...)
+	if err != nil {
+		return nil, err
+	}
+	a.(*adapter).filtered = true
+
+	return a.(*adapter), nil
+}
+
 type AdapterConfig struct {
 	DatabaseName   string
 	CollectionName string
 	Timeout        time.Duration
 	IsFiltered     bool
+	// DefaultDatabaseName is the database used when DatabaseName is empty,
+	// e.g. "casbin_dev" or "casbin_prod" depending on the environment. It
+	// defaults to "casbin".
+	DefaultDatabaseName string
+	// SaveTimeout, if not zero, replaces Timeout for SavePolicy and
+	// UpdateFilteredPolicies, which write many rules at once.
+	SaveTimeout time.Duration
+	// Context is the parent of every context the adapter uses internally,
+	// e.g. to carry tracing information or to cancel all in-flight operations
+	// at once. It defaults to context.Background().
+	Context context.Context
+	// Sharding, if not nil, shards the policy collection and configures its
+	// zones when the adapter is created. See ShardingConfig.
+	Sharding *ShardingConfig
+	// ShardCount, if greater than 1, distributes the rules over as many
+	// collections, named "<CollectionName>_0", "<CollectionName>_1" and so
+	// on, without MongoDB sharding. Every rule is stored in the collection
+	// chosen by a hash of its values, so writes and indexes are spread over
+	// the collections. Writing a rule only touches its collection, but reads
+	// fan out to all of them: LoadPolicy reads up to LoadConcurrency
+	// collections at once and merges them, so PreserveOrder only orders the
+	// rules of each collection. Since the hash covers all the values of a
+	// rule, a filter can't tell which collection stores the matching rules,
+	// and RemoveFilteredPolicy, UpdateFilteredPolicies and the other
+	// filtered operations query every collection. Moving a rule to another
+	// collection, which UpdatePolicy does when the new values hash
+	// differently, is a delete followed by an insert. The number of
+	// collections can't be changed without saving the policy again.
+	// Collection returns the first collection, and Watch requires the
+	// changeStream privilege on the database. It can't be combined with
+	// Sharding.
+	ShardCount int
+	// ReadTagSets, if not empty, pins reads to the replica set members
+	// matching the tag sets (e.g. {"region": "eu-west-1"}), using the nearest
+	// read preference. Writes always go to the primary.
+	ReadTagSets []tag.Set
+	// ReadPreference, if not nil, is the read preference of every policy
+	// operation, instead of the one of the client. It takes precedence over
+	// ReadTagSets.
+	ReadPreference *readpref.ReadPref
+	// LoadReadPreference, if not nil, is the read preference of the queries
+	// loading the policy into a model, e.g. readpref.SecondaryPreferred() to
+	// offload the primary when the loaded policy may be slightly stale. It
+	// takes precedence over ReadPreference for these queries only.
+	LoadReadPreference *readpref.ReadPref
+	// WriteConcern, if not nil, is the write concern of every policy
+	// operation, instead of the one of the client, e.g.
+	// writeconcern.Majority(). The adapters created from a URL or client
+	// options use the ones of the URL, e.g. "w=majority&readPreference=primary".
+	WriteConcern *writeconcern.WriteConcern
+	// PreserveOrder stores an explicit, monotonic "order" field on every
+	// inserted rule and loads the rules sorted by it, so the policy is loaded
+	// in insertion order even for rules inserted within the same second.
+	// The sequence is kept in the "<collection>_counters" collection.
+	PreserveOrder bool
+	// StableOrder loads the rules sorted by ptype then values, so repeated
+	// loads of the same rules fill the model in the same order. It doesn't
+	// apply to the aggregation pipelines passed to LoadFilteredPolicy, which
+	// can sort with a $sort stage. With ShardCount or LoadWorkers, the rules
+	// are still loaded in no particular order. It can't be combined with
+	// PreserveOrder.
+	StableOrder bool
+	// CheckDocumentSize makes the adapter compute the BSON size of every rule
+	// before writing it and reject the rules exceeding the 16MB document
+	// limit with ErrDocumentTooLarge, without a round-trip to the server.
+	CheckDocumentSize bool
+	// RequireExistingDatabase makes NewAdapterByDB return ErrDatabaseNotFound
+	// if the database doesn't exist yet, instead of silently creating it on
+	// the first write. This catches typos in the database name. The
+	// connected user needs the listDatabases privilege.
+	RequireExistingDatabase bool
+	// VerifyConnection makes NewAdapterByDB ping the server within Timeout
+	// and return the error if it's unreachable, since connecting a client
+	// doesn't, so a misconfiguration fails at startup rather than on the first
+	// operation.
+	VerifyConnection bool
+	// SaveConflict determines how SavePolicy handles rules of the model that
+	// collide under the unique index, e.g. variants that only differ in case
+	// when the index is case-insensitive. It defaults to ConflictError.
+	SaveConflict ConflictResolution
+	// Versioning makes every write increment a generation counter stored in
+	// the "<collection>_counters" collection, so that pollers can cheaply
+	// detect changes with Generation or LoadPolicyIfChanged. All the adapters
+	// writing to the collection must enable it.
+	Versioning bool
+	// WrapErrors annotates the returned errors with the adapter method and
+	// the MongoDB command that failed, e.g. "mongodbadapter: AddPolicies:
+	// insert into casbin.casbin_rule: <driver error>". The driver error is
+	// wrapped, so errors.As can still extract a mongo.CommandError.
+	WrapErrors bool
+	// OrderedRemove makes RemovePolicies remove the rules one by one, in a
+	// single ordered bulk write, stopping at the first rule it fails to
+	// remove. By default, it removes them all with a single DeleteMany. Rules
+	// that don't exist are never a failure.
+	OrderedRemove bool
+	// TruncateCapped makes LoadPolicyCapped log and skip the rules of a ptype
+	// past the cap, instead of failing with ErrPolicyTooLarge.
+	TruncateCapped bool
+	// StoreSection stores the section of every rule ("p" or "g") in a "sec"
+	// field, includes it in the selectors and the unique index, and only
+	// loads the rules stored for the section casbin assigns to their ptype.
+	// This lets models that use the same ptype in different sections share a
+	// collection. The unique index without "sec" of an existing collection
+	// must be dropped manually.
+	StoreSection bool
+	// ValueColumns is the number of value columns (v0, v1, ...) every rule is
+	// stored with and the unique index covers. It defaults to 6, the minimum;
+	// set it higher for models whose rules have more values. Values past the
+	// last column are still stored, but not covered by the unique index.
+	ValueColumns int
+	// DisableUniqueIndex makes the index over the rule fields non-unique, so
+	// duplicate rules are stored instead of failing with a duplicate key
+	// error. Switching an existing collection requires RebuildIndexes.
+	DisableUniqueIndex bool
+	// IndexKeys, if not empty, are the fields of the index over the rules,
+	// in order, instead of all of them: "sec", "ptype", "v0", "v1", and so
+	// on. On a sharded cluster, MongoDB only allows a unique index prefixed
+	// by the shard key, so the keys can be aligned with it. The index is
+	// unique only with IndexUnique, and rules colliding under it are then
+	// duplicates for SaveConflict and RemoveDuplicates. It can't be combined
+	// with DisableUniqueIndex. The index is named "casbin_keys_" followed by
+	// the name MongoDB would generate. Switching an existing collection
+	// requires RebuildIndexes, which replaces the index over the previous
+	// keys.
+	IndexKeys []string
+	// IndexUnique makes the index over IndexKeys unique.
+	IndexUnique bool
+	// TrimOnLoad trims the leading and trailing whitespace of every value
+	// when loading rules into a model, so rules stored with stray spaces
+	// still match. The stored rules are left untouched.
+	TrimOnLoad bool
+	// PreSaveValidate, if not nil, is called by SavePolicy with every rule of
+	// the model before anything is written. If it returns an error,
+	// SavePolicy returns it and the stored policy is left intact.
+	PreSaveValidate func(rules []CasbinRule) error
+	// CausalConsistency runs every operation in a causally consistent
+	// session advanced to the latest operation of the adapter, so that a read
+	// observes the preceding writes, even from a secondary. The guarantee
+	// holds across failovers only with majority read and write concerns.
+	CausalConsistency bool
+	// FieldTypes maps the index of a value (0 for v0) to the BSON type it is
+	// stored with, e.g. to store a priority as a number and filter it with
+	// numeric operators. The values are still strings in the model. Writing
+	// a rule fails if a value can't be converted to its type.
+	FieldTypes map[int]BSONType
+	// FieldNames renames the fields the rules are stored with, e.g.
+	// []string{"policy_type", "value_0", "value_1"}: the first name replaces
+	// "ptype" and the next ones "v0", "v1", and so on. Empty names keep the
+	// default. The adapter uses the names in its indexes and selectors, but
+	// the filters passed to LoadFilteredPolicy are used as is, so they must
+	// refer to the configured names.
+	FieldNames []string
+	// LoadConcurrency is the maximum number of collections
+	// LoadPolicyFromCollections, or the loads with ShardCount, read at once.
+	// It defaults to 1.
+	LoadConcurrency int
+	// LoadWorkers, if greater than 1, is the number of goroutines decoding
+	// and adding the loaded rules to the model while the cursor streams,
+	// which speeds up loads with a costly processing of every rule. The
+	// rules are then added to the model in no particular order, even with
+	// PreserveOrder.
+	LoadWorkers int
+	// LoadRetries is the number of times LoadPolicy and LoadFilteredPolicy
+	// start over when the cursor is lost (CursorNotFound) or the connection
+	// fails while loading. The partially loaded policy is cleared from the
+	// model before every retry.
+	LoadRetries int
+	// BatchSize, if positive, is the number of rules the server returns per
+	// batch when loading, instead of the server default. Smaller batches
+	// bound the memory held by the cursor while loading a huge policy, at
+	// the cost of more round-trips.
+	BatchSize int32
+	// Timestamps stores the time every rule was added in a createdAt field,
+	// and the time it was last updated by UpdatePolicy, UpdatePolicies or
+	// UpdatePolicyByKey in an updatedAt field, e.g. for audits. SavePolicy
+	// rewrites every rule, so their createdAt becomes the time of the save.
+	Timestamps bool
+	// SoftDelete keeps the removed rules in the collection, marking them with
+	// the time of their removal in a deletedAt field instead of deleting
+	// them, e.g. to keep the history of the policy for audits. The rules
+	// marked deleted are ignored by every other operation, and SavePolicy
+	// marks all the stored rules deleted before inserting the policy.
+	// PurgeDeleted deletes the old ones. The unique index covers deletedAt,
+	// so a removed rule can be added again; switching an existing collection
+	// requires RebuildIndexes, which replaces the previous unique index.
+	// Watch reports the removals as updates.
+	SoftDelete bool
+	// ValidateOnLoad checks, after LoadPolicy and LoadFilteredPolicy, that
+	// the rules of every ptype of the model have the same number of values:
+	// the number of tokens of the policy definition, or else the most
+	// common one. Rules of mixed lengths, e.g. with values stored in extra
+	// fields by another tool, make the enforcer fail or panic later, so
+	// the load returns ErrInconsistentArity listing them instead. The rules
+	// stay loaded in the model.
+	ValidateOnLoad bool
+	// MaxRetries is the number of times a write failing with a transient
+	// error (a timeout, or an error labelled retryable by the server, e.g.
+	// during a primary step-down) is retried, with an exponential backoff.
+	// It defaults to 3, and a negative value disables the retries. Logical
+	// errors, like duplicate keys, are never retried. An insert whose
+	// response was lost may fail with a duplicate key error when retried.
+	MaxRetries int
+	// ExpiryFieldIndex, if positive, is the index of the value holding the
+	// expiry date of the rules (e.g. 4 for v4), as an RFC 3339 date-time or
+	// a YYYY-MM-DD date. The adapter stores it parsed in the expiresAt field
+	// of the rules, with a TTL index removing the expired rules. An empty
+	// or malformed value never expires. MongoDB removes the expired rules
+	// about every minute, without updating the models that loaded them.
+	ExpiryFieldIndex int
+	// SkipIndexCreation doesn't create the indexes when the adapter is
+	// created, for users lacking the createIndex privilege whose indexes are
+	// managed out of band. VerifyIndexes checks them. The URL constructors
+	// take WithoutIndexCreation instead.
+	SkipIndexCreation bool
+	// WarmPool establishes WarmPoolSize connections when the adapter is
+	// created, by running as many concurrent warm-up queries, so that the
+	// first operations don't pay the connection latency.
+	WarmPool bool
+	// WarmPoolSize is the number of connections WarmPool establishes. It
+	// defaults to 1, and should not exceed the MinPoolSize of the client,
+	// since the connections above it are closed once idle.
+	WarmPoolSize int
+	// Observer, if not nil, is notified of the duration and the outcome of
+	// every operation, e.g. LoadPolicy, SavePolicy or AddPolicy.
+	Observer Observer
+	// TracerProvider, if not nil, provides the tracer of the spans the
+	// methods taking a context start around their operations, as children of
+	// the span of the context, e.g. "mongodb-adapter/LoadPolicy" for
+	// LoadPolicyCtx. The spans carry the ptype and the number of rules as
+	// the casbin.ptype and casbin.rules attributes, where they apply, and
+	// the error the method returned. No span is recorded by default.
+	TracerProvider trace.TracerProvider
+	// OnDecodeError, if not nil, is called by the loads with every document
+	// that can't be decoded into a rule, e.g. with a ptype that isn't a
+	// string, and the decoding error. If it returns nil, the document
+	// is skipped and the load goes on; otherwise the load fails with the
+	// error it returned. By default, a malformed document fails the load.
+	// It may be called concurrently with LoadWorkers.
+	OnDecodeError func(raw bson.Raw, err error) error
+	// DeterministicID derives the _id of every rule from its ptype and
+	// values, with a hash, instead of letting MongoDB generate it. Identical
+	// rules then have the same _id, so adding a rule twice fails with a
+	// duplicate key error even without the unique index, and the removals
+	// select the rules by _id. Updating a rule changes its _id, so it is a
+	// delete followed by an insert, and UpdatePolicies updates the rules one
+	// by one. The _id isn't in insertion order, so LoadNewRules can't be
+	// used. The rules stored before enabling it must be saved again. It
+	// can't be combined with SoftDelete, which keeps the removed rules.
+	DeterministicID bool
+	// LongValueThreshold, if positive, is the length past which a value, e.g.
+	// a JSON sub-rule, is stored apart, in a field named after its value
+	// field with a "_long" suffix (e.g. "v0_long"), which isn't indexed. The
+	// value field then holds a placeholder, "sha256:" followed by the hex
+	// SHA-256 hash of the value, so the unique index stays small and still
+	// tells the rules apart. The loads reconstruct the full values. The
+	// filters of RemoveFilteredPolicy and the other filtered operations
+	// match the long values, but the ones passed to LoadFilteredPolicy are
+	// used as is, so they must match the placeholders. It must be at least
+	// 71, the length of a placeholder.
+	LongValueThreshold int
+	// MaxValueLength, if positive, is the maximum length in bytes of the
+	// values of the written rules. A longer value is rejected with
+	// ErrValueTooLong before reaching the server, rather than failing with a
+	// server error about the index key size. It doesn't apply to the values
+	// stored apart with LongValueThreshold. When it is zero and the unique
+	// index is enabled without LongValueThreshold, the rules whose indexed
+	// values together exceed 1024 bytes, the index key limit of MongoDB, are
+	// rejected with ErrValueTooLong instead. A negative value disables both
+	// checks.
+	MaxValueLength int
+	// AppName names the application in the handshake with the server, shown
+	// in its logs and currentOp. The name is part of the connection, so it
+	// can't be applied to the client passed to NewAdapterByDB, which rejects
+	// it: set it on the options of that client with SetAppName, or pass the
+	// AppName option to the URL constructors.
+	AppName string
 }
 
+// ShardingConfig describes how the policy collection is distributed over a
+// sharded cluster. It is applied through admin commands, so the connected
+// user needs the enableSharding, shardCollection, addShardToZone and
+// updateZoneKeyRange privileges (e.g. the built-in clusterManager role).
+//
+// MongoDB only allows a unique index on a sharded collection if the index is
+// prefixed by the shard key, so the key must start with "ptype" (optionally
+// followed by "v0", "v1", ... in order), unless AdapterConfig.IndexKeys
+// aligns the index with it.
+type ShardingConfig struct {
+	// Key is the shard key, e.g. bson.D{{Key: "ptype", Value: 1}, {Key: "v0", Value: 1}}.
+	Key bson.D
+	// Zones pins ranges of the shard key to specific shards.
+	Zones []ShardZone
+}
+
+// ShardZone associates a range of the shard key with a zone and the shards
+// that belong to it. Min is inclusive and Max is exclusive.
+type ShardZone struct {
+	Name   string
+	Shards []string
+	Min    bson.D
+	Max    bson.D
+}
+
+// NewAdapterByDB creates an adapter storing the policy with the client,
+// configured by config. The client is owned by the caller: the adapter never
+// disconnects it.
 func NewAdapterByDB(client *mongo.Client, config *AdapterConfig) (persist.BatchAdapter, error) {
 	if config == nil {
 		config = &AdapterConfig{}
@@ -150,6 +1337,9 @@ func NewAdapterByDB(client *mongo.Client, config *AdapterConfig) (persist.BatchA
 	if config.CollectionName == "" {
 		config.CollectionName = defaultCollectionName
 	}
+	if config.DatabaseName == "" {
+		config.DatabaseName = config.DefaultDatabaseName
+	}
 	if config.DatabaseName == "" {
 		config.DatabaseName = defaultDatabaseName
 	}
@@ -157,27 +1347,192 @@ func NewAdapterByDB(client *mongo.Client, config *AdapterConfig) (persist.BatchA
 		config.Timeout = defaultTimeout
 	}
 
-	collection := client.Database(config.DatabaseName).Collection(config.CollectionName)
-
-	a := &adapter{
-		client:     client,
-		collection: collection,
-		timeout:    config.Timeout,
-		filtered:   config.IsFiltered,
-	}
-
-	if err := a.prepareIndexes(); err != nil {
+	names, err := newFieldNames(config.FieldNames)
+	if err != nil {
 		return nil, err
 	}
+	if config.ShardCount > 1 && config.Sharding != nil {
+		return nil, errors.New("ShardCount can't be combined with Sharding")
+	}
+	if config.StableOrder && config.PreserveOrder {
+		return nil, errors.New("StableOrder can't be combined with PreserveOrder")
+	}
+	if config.LongValueThreshold > 0 && config.LongValueThreshold < len(longValuePlaceholder("")) {
+		return nil, fmt.Errorf("LongValueThreshold must be at least %d", len(longValuePlaceholder("")))
+	}
+	if config.DeterministicID && config.SoftDelete {
+		return nil, errors.New("DeterministicID can't be combined with SoftDelete")
+	}
+	if config.AppName != "" {
+		return nil, errors.New("AppName can't be applied to a connected client")
+	}
+	if len(config.IndexKeys) > 0 {
+		if config.DisableUniqueIndex {
+			return nil, errors.New("IndexKeys can't be combined with DisableUniqueIndex")
+		}
+		if err := validateIndexKeys(config.IndexKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	db := client.Database(config.DatabaseName)
+	collectionOption := collectionOptions(config)
+	var shards []*mongo.Collection
+	for i := 0; i < config.ShardCount && config.ShardCount > 1; i++ {
+		name := fmt.Sprintf("%s_%d", config.CollectionName, i)
+		shards = append(shards, db.Collection(name, collectionOption))
+	}
+	collection := db.Collection(config.CollectionName, collectionOption)
+	if shards != nil {
+		collection = shards[0]
+	}
+
+	a := &adapter{
+		client:            client,
+		maintenance:       new(atomic.Bool),
+		collection:        collection,
+		shards:            shards,
+		collectionOption:  collectionOption,
+		loadReadPref:      config.LoadReadPreference,
+		saveTimeout:       config.SaveTimeout,
+		filtered:          config.IsFiltered,
+		ctx:               config.Context,
+		preserveOrder:     config.PreserveOrder,
+		stableOrder:       config.StableOrder,
+		checkDocumentSize: config.CheckDocumentSize,
+		saveConflict:      config.SaveConflict,
+		versioning:        config.Versioning,
+		wrapErrors:        config.WrapErrors,
+		orderedRemove:     config.OrderedRemove,
+		truncateCapped:    config.TruncateCapped,
+		storeSection:      config.StoreSection,
+		valueColumns:      config.ValueColumns,
+		uniqueIndex:       !config.DisableUniqueIndex,
+		indexKeys:         config.IndexKeys,
+		trimOnLoad:        config.TrimOnLoad,
+		preSaveValidate:   config.PreSaveValidate,
+		loadRetries:       config.LoadRetries,
+		batchSize:         config.BatchSize,
+		validateOnLoad:    config.ValidateOnLoad,
+		softDelete:        config.SoftDelete,
+		timestamps:        config.Timestamps,
+		causalConsistency: config.CausalConsistency,
+		fieldTypes:        config.FieldTypes,
+		fieldNames:        names,
+		loadConcurrency:   config.LoadConcurrency,
+		loadWorkers:       config.LoadWorkers,
+		expiryFieldIndex:  config.ExpiryFieldIndex,
+		skipIndexCreation: config.SkipIndexCreation,
+		observer:          config.Observer,
+		onDecodeError:     config.OnDecodeError,
+		deterministicID:   config.DeterministicID,
+		longValues:        config.LongValueThreshold,
+		maxValueLength:    config.MaxValueLength,
+	}
+	if config.TracerProvider != nil {
+		a.tracer = config.TracerProvider.Tracer(tracerName)
+	}
+
+	if len(config.IndexKeys) > 0 {
+		a.uniqueIndex = config.IndexUnique
+	}
+	// The long values only leave their placeholders in the index.
+	a.checkKeySize = a.maxValueLength == 0 && a.uniqueIndex && a.longValues == 0
+	a.timeout.Store(int64(config.Timeout))
+
+	switch {
+	case config.MaxRetries == 0:
+		a.maxRetries = defaultMaxRetries
+	case config.MaxRetries > 0:
+		a.maxRetries = config.MaxRetries
+	}
+
+	if config.VerifyConnection {
+		if err := a.ping(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RequireExistingDatabase {
+		if err := a.checkDatabaseExists(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Sharding != nil {
+		if err := a.shardCollection(config.Sharding); err != nil {
+			return nil, err
+		}
+	}
+
+	if !a.skipIndexCreation {
+		if err := a.prepareIndexes(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.WarmPool {
+		if err := a.warmPool(config.WarmPoolSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Call the destructor when the object is released.
+	runtime.SetFinalizer(a, finalizer)
 
-	// Call the destructor when the object is released.
-	runtime.SetFinalizer(a, finalizer)
-
 	return a, nil
 }
 
+// warmPool runs size concurrent warm-up queries on the collection, so that
+// the pool of the client holds at least size connections to the server the
+// reads are routed to.
+func (a *adapter) warmPool(size int) error {
+	if size < 1 {
+		size = 1
+	}
+
+	errs := make(chan error, size)
+	opts := options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	for i := 0; i < size; i++ {
+		go func() {
+			// Every query has its own context, since a causally
+			// consistent session can't be shared between goroutines.
+			ctx, cancel := a.timeoutContext(a.baseContext())
+			defer cancel()
+			err := a.collection.FindOne(ctx, bson.D{}, opts).Err()
+			if err == mongo.ErrNoDocuments {
+				err = nil
+			}
+			errs <- err
+		}()
+	}
+
+	var firstErr error
+	for i := 0; i < size; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = a.commandError("find", a.collection, err)
+		}
+	}
+	return firstErr
+}
+
+// collectionOptions returns the options of the policy collection described
+// by the config.
+func collectionOptions(config *AdapterConfig) *options.CollectionOptions {
+	collectionOption := options.Collection()
+	if config.ReadPreference != nil {
+		collectionOption.SetReadPreference(config.ReadPreference)
+	} else if len(config.ReadTagSets) > 0 {
+		collectionOption.SetReadPreference(readpref.Nearest(readpref.WithTagSets(config.ReadTagSets...)))
+	}
+	if config.WriteConcern != nil {
+		collectionOption.SetWriteConcern(config.WriteConcern)
+	}
+	return collectionOption
+}
+
 func (a *adapter) open(clientOption *options.ClientOptions, databaseName string, collectionName string) error {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.timeoutContext(a.baseContext())
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, clientOption)
@@ -190,427 +1545,3711 @@ func (a *adapter) open(clientOption *options.ClientOptions, databaseName string,
 
 	a.client = client
 	a.collection = collection
+	a.ownsClient = true
 
+	if a.skipIndexCreation {
+		return nil
+	}
 	if err = a.prepareIndexes(); err != nil {
+		// The adapter isn't returned, so nothing else would disconnect it.
+		_ = a.close()
 		return err
 	}
 
 	return nil
 }
 
-func (a *adapter) prepareIndexes() error {
-	indexes := []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+// indexKeysPrefix starts the name of the index over AdapterConfig.IndexKeys,
+// so that RebuildIndexes tells it apart from the indexes of the user.
+const indexKeysPrefix = "casbin_keys_"
+
+// indexModels returns the indexes the adapter maintains on the collection.
+func (a *adapter) indexModels() []mongo.IndexModel {
+	indexes := a.indexKeys
+	if len(indexes) == 0 {
+		indexes = a.ruleFields()
+	}
 	keysDoc := bson.D{}
 
 	for _, k := range indexes {
 		keyDoc := bson.E{}
-		keyDoc.Key = k
+		keyDoc.Key = a.fieldNames.field(k)
 		keyDoc.Value = 1
 		keysDoc = append(keysDoc, keyDoc)
 	}
+	if a.softDelete {
+		// Only one copy of a rule isn't marked deleted.
+		keysDoc = append(keysDoc, bson.E{Key: "deletedAt", Value: 1})
+	}
 
-	if _, err := a.collection.Indexes().CreateOne(
-		context.Background(),
-		mongo.IndexModel{
+	models := []mongo.IndexModel{
+		{
 			Keys:    keysDoc,
-			Options: options.Index().SetUnique(true),
+			Options: options.Index().SetUnique(a.uniqueIndex),
 		},
-	); err != nil {
+	}
+	if len(a.indexKeys) > 0 {
+		models[0].Options.SetName(indexKeysPrefix + indexName(keysDoc))
+	}
+
+	if a.preserveOrder {
+		models = append(models, mongo.IndexModel{
+			Keys: bson.D{{Key: "order", Value: 1}},
+		})
+	}
+
+	if a.expiryFieldIndex > 0 {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+	}
+
+	return models
+}
+
+// ruleFields returns the fields identifying a rule.
+func (a *adapter) ruleFields() []string {
+	fields := []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+	for i := 6; i < a.valueColumns; i++ {
+		fields = append(fields, fmt.Sprintf("v%d", i))
+	}
+	if a.storeSection {
+		fields = append([]string{"sec"}, fields...)
+	}
+	return fields
+}
+
+// validateIndexKeys checks that the keys are distinct rule fields.
+func validateIndexKeys(keys []string) error {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if _, ok := valueIndex(key); !ok && key != "ptype" && key != "sec" {
+			return fmt.Errorf("index key %q is not a rule field", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate index key %q", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// ruleIndexNames returns the names of the index the adapter creates over all
+// the rule fields, with and without deletedAt, so that RebuildIndexes drops
+// the one created before SoftDelete was switched.
+func (a *adapter) ruleIndexNames() []string {
+	keys := bson.D{}
+	for _, k := range a.ruleFields() {
+		keys = append(keys, bson.E{Key: a.fieldNames.field(k), Value: 1})
+	}
+	return []string{indexName(keys), indexName(append(keys, bson.E{Key: "deletedAt", Value: 1}))}
+}
+
+// indexKeysNames returns the names of the indexes the adapter created over
+// AdapterConfig.IndexKeys, the current ones or previous ones.
+func (a *adapter) indexKeysNames(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, a.commandError("listIndexes", collection, err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, a.commandError("listIndexes", collection, err)
+	}
+
+	var names []string
+	for _, index := range indexes {
+		if strings.HasPrefix(index.Name, indexKeysPrefix) {
+			names = append(names, index.Name)
+		}
+	}
+	return names, nil
+}
+
+// modelName returns the name of the index of the model.
+func modelName(m mongo.IndexModel) string {
+	if m.Options != nil && m.Options.Name != nil {
+		return *m.Options.Name
+	}
+	return indexName(m.Keys.(bson.D))
+}
+
+// indexName returns the name MongoDB generates for an index on keys.
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// isNotFound reports whether err means that the collection or the index
+// doesn't exist.
+func isNotFound(err error) bool {
+	var mongoErr mongo.CommandError
+	// (NamespaceNotFound) ns not found, (IndexNotFound) index not found with name
+	return errors.As(err, &mongoErr) && (mongoErr.Code == 26 || mongoErr.Code == 27)
+}
+
+func (a *adapter) prepareIndexes() error {
+	for _, collection := range a.collections() {
+		if _, err := collection.Indexes().CreateMany(a.baseContext(), a.indexModels()); err != nil {
+			return a.commandError("createIndexes", collection, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveDuplicates deletes the rules stored more than once, e.g. before the
+// unique index was created or while it was dropped, keeping the first stored
+// copy of each, and returns the number of rules deleted. The copies are the
+// rules colliding under the unique index, or with the same values if the
+// index isn't unique. Creating an adapter fails while the
+// unique index can't be built, so clean up such a collection with an adapter
+// created with AdapterConfig.SkipIndexCreation, then call RebuildIndexes.
+func (a *adapter) RemoveDuplicates(ctx context.Context) (removed int64, err error) {
+	defer a.observe("RemoveDuplicates", &err)()
+	defer a.wrapError("RemoveDuplicates", &err)
+
+	ctx, span := a.startSpan(ctx, "RemoveDuplicates")
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	keys := a.ruleFields()
+	if a.uniqueIndex && len(a.indexKeys) > 0 {
+		keys = append([]string(nil), a.indexKeys...)
+	}
+	if a.softDelete {
+		keys = append(keys, "deletedAt")
+	}
+	group := bson.D{}
+	for _, key := range keys {
+		key = a.fieldNames.field(key)
+		group = append(group, bson.E{Key: key, Value: "$" + key})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	}
+	for _, collection := range a.collections() {
+		cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return removed, a.commandError("aggregate", collection, err)
+		}
+		var groups []struct {
+			IDs []primitive.ObjectID `bson:"ids"`
+		}
+		if err := cursor.All(ctx, &groups); err != nil {
+			return removed, a.commandError("aggregate", collection, err)
+		}
+
+		var ids bson.A
+		for _, g := range groups {
+			// The first copy is kept.
+			for _, id := range g.IDs[1:] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		// The copies are deleted even with softDelete, since they don't
+		// hold any history.
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return removed, a.commandError("delete", collection, err)
+		}
+		removed += result.DeletedCount
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, a.bumpGeneration(ctx)
+}
+
+// RebuildIndexes drops and recreates the indexes maintained by the adapter
+// according to its current configuration. It also drops the index it
+// created over all the rule fields or over previous AdapterConfig.IndexKeys
+// before AdapterConfig.SoftDelete or AdapterConfig.IndexKeys was switched,
+// but no index created by the user.
+//
+// When seeding a large policy, it is faster to insert the rules into a
+// collection without indexes and build the indexes once afterwards than to
+// maintain them on every insert: load the data first, then call
+// RebuildIndexes.
+func (a *adapter) RebuildIndexes(ctx context.Context) (err error) {
+	defer a.observe("RebuildIndexes", &err)()
+	defer a.wrapError("RebuildIndexes", &err)
+
+	ctx, span := a.startSpan(ctx, "RebuildIndexes")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	models := a.indexModels()
+	names := a.ruleIndexNames()
+	for _, m := range models {
+		names = append(names, modelName(m))
+	}
+	for _, collection := range a.collections() {
+		keysNames, err := a.indexKeysNames(ctx, collection)
+		if err != nil {
+			return err
+		}
+		for _, name := range append(keysNames, names...) {
+			if _, err := collection.Indexes().DropOne(ctx, name); err != nil && !isNotFound(err) {
+				return a.commandError("dropIndexes", collection, err)
+			}
+		}
+
+		if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+			return a.commandError("createIndexes", collection, err)
+		}
+	}
+	return nil
+}
+
+// migrateBatchSize is the number of updates Migrate sends at once.
+const migrateBatchSize = 1000
+
+// Migrate calls fn with every stored rule, including the rules marked deleted
+// with AdapterConfig.SoftDelete, and applies the update documents it returns,
+// e.g. bson.M{"$set": bson.M{"tenant": "default"}} to backfill a field added
+// by a schema change. fn returns false to leave a rule unchanged. Call
+// RebuildIndexes afterwards if the change affects the indexes.
+func (a *adapter) Migrate(ctx context.Context, fn func(rule CasbinRule) (bson.M, bool)) (err error) {
+	defer a.observe("Migrate", &err)()
+	defer a.wrapError("Migrate", &err)
+
+	ctx, span := a.startSpan(ctx, "Migrate")
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
 		return err
 	}
 
+	ctx, cancel := a.saveContext(ctx)
+	defer cancel()
+
+	var updated int64
+	for _, collection := range a.collections() {
+		n, err := a.migrateCollection(ctx, collection, fn)
+		updated += n
+		if err != nil {
+			return err
+		}
+	}
+
+	if updated == 0 {
+		return nil
+	}
+	return a.bumpGeneration(ctx)
+}
+
+// migrateCollection applies the updates fn returns to the rules of the
+// collection, and returns the number of rules updated.
+func (a *adapter) migrateCollection(ctx context.Context, collection *mongo.Collection, fn func(rule CasbinRule) (bson.M, bool)) (int64, error) {
+	findOption := options.Find()
+	if a.batchSize > 0 {
+		findOption.SetBatchSize(a.batchSize)
+	}
+	cursor, err := collection.Find(ctx, bson.D{}, findOption)
+	if err != nil {
+		return 0, a.commandError("find", collection, err)
+	}
+	defer cursor.Close(ctx)
+
+	var updated int64
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		result, err := collection.BulkWrite(ctx, models)
+		if result != nil {
+			updated += result.ModifiedCount
+		}
+		models = models[:0]
+		return a.commandError("update", collection, err)
+	}
+
+	for cursor.Next(ctx) {
+		line := a.newLine()
+		if ok, err := a.decodeLine(cursor.Current, &line); !ok {
+			if err != nil {
+				return updated, err
+			}
+			continue
+		}
+		update, ok := fn(line)
+		if !ok {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": line.ID}).SetUpdate(update))
+		if len(models) == migrateBatchSize {
+			if err := flush(); err != nil {
+				return updated, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return updated, a.commandError("find", collection, err)
+	}
+	return updated, flush()
+}
+
+// VerifyIndexes checks that the indexes the adapter maintains exist on the
+// collection as its current configuration expects them, e.g. that the index
+// over the rule fields is unique. It returns ErrIndexMismatch listing every
+// discrepancy, so that a service can refuse to start if an index managed
+// externally was altered or dropped.
+func (a *adapter) VerifyIndexes(ctx context.Context) (err error) {
+	defer a.observe("VerifyIndexes", &err)()
+	defer a.wrapError("VerifyIndexes", &err)
+
+	ctx, span := a.startSpan(ctx, "VerifyIndexes")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	var problems []string
+	for _, collection := range a.collections() {
+		collectionProblems, err := a.verifyIndexes(ctx, collection)
+		if err != nil {
+			return err
+		}
+		for _, problem := range collectionProblems {
+			if len(a.shards) > 0 {
+				problem = collection.Name() + ": " + problem
+			}
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrIndexMismatch, strings.Join(problems, "; "))
+	}
 	return nil
 }
 
-func (a *adapter) close() {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+// verifyIndexes returns the discrepancies between the indexes of the
+// collection and the ones the adapter maintains.
+func (a *adapter) verifyIndexes(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, a.commandError("listIndexes", collection, err)
+	}
+	var indexes []struct {
+		Key                bson.D `bson:"key"`
+		Unique             bool   `bson:"unique"`
+		ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, a.commandError("listIndexes", collection, err)
+	}
+
+	var problems []string
+	for _, m := range a.indexModels() {
+		keys := m.Keys.(bson.D)
+		name := indexName(keys)
+		found := -1
+		for i, index := range indexes {
+			if indexName(index.Key) == name {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			problems = append(problems, fmt.Sprintf("index %s is missing", name))
+			continue
+		}
+
+		index := indexes[found]
+		unique := m.Options != nil && m.Options.Unique != nil && *m.Options.Unique
+		if index.Unique && !unique {
+			problems = append(problems, fmt.Sprintf("index %s is unique", name))
+		} else if !index.Unique && unique {
+			problems = append(problems, fmt.Sprintf("index %s is not unique", name))
+		}
+		if m.Options != nil && m.Options.ExpireAfterSeconds != nil {
+			if index.ExpireAfterSeconds == nil || *index.ExpireAfterSeconds != int64(*m.Options.ExpireAfterSeconds) {
+				problems = append(problems, fmt.Sprintf("index %s doesn't expire documents after %d seconds", name, *m.Options.ExpireAfterSeconds))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// IndexStats returns the usage statistics of every index of the collection,
+// as returned by the $indexStats aggregation stage: the index name, its key
+// and the number of operations that used it since the server started. It
+// helps to find unused indexes. With ShardCount, the statistics of every
+// collection follow each other. The connected user needs the indexStats
+// privilege.
+func (a *adapter) IndexStats(ctx context.Context) (stats []bson.M, err error) {
+	defer a.observe("IndexStats", &err)()
+	defer a.wrapError("IndexStats", &err)
+
+	ctx, span := a.startSpan(ctx, "IndexStats")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{{{Key: "$indexStats", Value: bson.D{}}}}
+	for _, collection := range a.collections() {
+		cursor, err := collection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, a.commandError("aggregate", collection, err)
+		}
+		var collectionStats []bson.M
+		if err := cursor.All(ctx, &collectionStats); err != nil {
+			return nil, a.commandError("aggregate", collection, err)
+		}
+		stats = append(stats, collectionStats...)
+	}
+	return stats, nil
+}
+
+// PolicyChange is a change of the policy collection delivered by Watch.
+type PolicyChange struct {
+	// Operation is the change stream operation type: "insert", "update",
+	// "replace" and "delete" for a single rule, or "drop", "rename" and
+	// "dropDatabase" when the whole collection went away, which
+	// SavePolicy does.
+	Operation string
+	// ID is the _id of the changed rule, or zero for collection events.
+	ID primitive.ObjectID
+	// Rule is the rule after an insert, update or replace. For a delete it
+	// is the deleted rule if the collection records pre-images
+	// (changeStreamPreAndPostImages), and nil otherwise.
+	Rule *CasbinRule
+	// Err is set on the last change sent when the stream fails and can't
+	// be resumed. The channel is closed right after, and the consumer
+	// should reload the policy and watch again.
+	Err error
+}
+
+// changeEvent is the part of a change stream event that Watch uses.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument             bson.Raw `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.Raw `bson:"fullDocumentBeforeChange"`
+}
+
+// Watch opens a change stream on the collection and sends every change of
+// the stored policy to the returned channel, so that enforcers sharing the
+// collection can stay in sync. A consumer can apply the rule of each change
+// incrementally, or simply call LoadPolicy.
+//
+// The stream is resumed from the last received event after a transient
+// error, and it is restarted after SavePolicy drops the collection. The
+// channel is closed when ctx is cancelled. Change streams require a replica
+// set or a sharded cluster.
+func (a *adapter) Watch(ctx context.Context) (changes <-chan PolicyChange, err error) {
+	defer a.observe("Watch", &err)()
+	defer a.wrapError("Watch", &err)
+
+	ctx, span := a.startSpan(ctx, "Watch")
+	defer endSpan(span, &err)
+
+	stream, err := a.openChangeStream(ctx, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan PolicyChange)
+	go a.watch(ctx, stream, ch)
+	return ch, nil
+}
+
+// openChangeStream opens a change stream on the collection, resuming after
+// token, or starting after it if the previous stream was invalidated.
+func (a *adapter) openChangeStream(ctx context.Context, token bson.Raw, startAfter bool) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if token != nil {
+		if startAfter {
+			opts.SetStartAfter(token)
+		} else {
+			opts.SetResumeAfter(token)
+		}
+	}
+
+	var stream *mongo.ChangeStream
+	var err error
+	if len(a.shards) > 0 {
+		// A single stream on the database sees the changes of every shard.
+		names := make(bson.A, 0, len(a.shards))
+		for _, shard := range a.shards {
+			names = append(names, shard.Name())
+		}
+		pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"ns.coll": bson.M{"$in": names}}}}}
+		stream, err = a.collection.Database().Watch(ctx, pipeline, opts)
+	} else {
+		stream, err = a.collection.Watch(ctx, mongo.Pipeline{}, opts)
+	}
+	if err != nil {
+		return nil, a.commandError("aggregate", a.collection, err)
+	}
+	return stream, nil
+}
+
+// watch sends the events of stream to changes until ctx is cancelled,
+// reopening the stream when it ends.
+func (a *adapter) watch(ctx context.Context, stream *mongo.ChangeStream, changes chan<- PolicyChange) {
+	defer close(changes)
+
+	for {
+		invalidated := false
+		for !invalidated && stream.Next(ctx) {
+			var event changeEvent
+			if err := stream.Decode(&event); err != nil {
+				log.Printf("[WARNING] skipping change stream event: %v", err)
+				continue
+			}
+
+			if event.OperationType == "invalidate" {
+				invalidated = true
+				continue
+			}
+			change := PolicyChange{
+				Operation: event.OperationType,
+				ID:        event.DocumentKey.ID,
+			}
+			doc := event.FullDocument
+			if event.OperationType == "delete" {
+				doc = event.FullDocumentBeforeChange
+			}
+			if doc != nil {
+				line := a.newLine()
+				if err := bson.Unmarshal(doc, &line); err != nil {
+					log.Printf("[WARNING] skipping change stream event: %v", err)
+					continue
+				}
+				change.Rule = &line
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+			}
+		}
+
+		token := stream.ResumeToken()
+		streamErr := stream.Err()
+		_ = stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		if streamErr != nil {
+			log.Printf("[WARNING] change stream interrupted, resuming: %v", streamErr)
+		}
+
+		// The driver has already retried once on resumable errors, so
+		// this is the last attempt before giving up.
+		var err error
+		stream, err = a.openChangeStream(ctx, token, invalidated)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case changes <- PolicyChange{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+}
+
+// checkLineSizes returns ErrValueTooLong if a value of the lines exceeds
+// maxValueLength or, with checkKeySize, if the key of one of the lines in the
+// unique index exceeds the index key limit, and, with checkDocumentSize,
+// ErrDocumentTooLarge if one of the lines exceeds the maximum BSON document
+// size.
+func (a *adapter) checkLineSizes(lines ...CasbinRule) error {
+	if a.maxValueLength > 0 {
+		for _, line := range lines {
+			if err := a.checkValueLengths(&line); err != nil {
+				return err
+			}
+		}
+	}
+	if a.checkKeySize {
+		for _, line := range lines {
+			if size := a.indexKeySize(&line); size > maxIndexKeySize {
+				return fmt.Errorf("%w: the index key of a %s rule has about %d bytes, more than %d", ErrValueTooLong, line.PType, size, maxIndexKeySize)
+			}
+		}
+	}
+	if !a.checkDocumentSize {
+		return nil
+	}
+
+	for _, line := range lines {
+		doc, err := bson.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if len(doc) >= maxDocumentSize {
+			return fmt.Errorf("%w: %s rule of %d bytes", ErrDocumentTooLarge, line.PType, len(doc))
+		}
+	}
+	return nil
+}
+
+// checkValueLengths returns ErrValueTooLong if a value of the line, other than
+// the long values stored apart, exceeds maxValueLength.
+func (a *adapter) checkValueLengths(line *CasbinRule) error {
+	for i, value := range line.rule() {
+		if a.longValues > 0 && len(value) > a.longValues {
+			continue
+		}
+		if len(value) > a.maxValueLength {
+			return fmt.Errorf("%w: value %d of a %s rule has %d bytes, more than %d", ErrValueTooLong, i, line.PType, len(value), a.maxValueLength)
+		}
+	}
+	return nil
+}
+
+// indexKeySize returns an estimate of the size of the key of the line in the
+// index over the rules: the length of the indexed values, each with the two
+// bytes of its type and terminator.
+func (a *adapter) indexKeySize(line *CasbinRule) int {
+	fields := a.indexKeys
+	if len(fields) == 0 {
+		fields = a.ruleFields()
+	}
+	rule := line.rule()
+	size := 0
+	for _, field := range fields {
+		value := ""
+		switch field {
+		case "sec":
+			value = line.Sec
+		case "ptype":
+			value = line.PType
+		default:
+			if n, ok := valueIndex(field); ok && n < len(rule) {
+				value = rule[n]
+			}
+		}
+		size += len(value) + 2
+	}
+	return size
+}
+
+// assignOrder sets the Order of the lines to the next values of the
+// insertion sequence. It does nothing unless preserveOrder is enabled.
+func (a *adapter) assignOrder(ctx context.Context, lines []CasbinRule) error {
+	if !a.preserveOrder || len(lines) == 0 {
+		return nil
+	}
+
+	last, err := a.incrementCounter(ctx, "order", int64(len(lines)))
+	if err != nil {
+		return err
+	}
+
+	first := last - int64(len(lines)) + 1
+	for i := range lines {
+		lines[i].Order = first + int64(i)
+	}
+	return nil
+}
+
+// counters returns the collection holding the sequences of the adapter.
+func (a *adapter) counters() *mongo.Collection {
+	return a.collection.Database().Collection(a.collection.Name() + "_counters")
+}
+
+// incrementCounter atomically adds n to the named sequence and returns its
+// new value.
+func (a *adapter) incrementCounter(ctx context.Context, name string, n int64) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := a.counters().FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": n}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, a.commandError("findAndModify", a.counters(), err)
+}
+
+// bumpGeneration increments the generation of the stored policy after a
+// write. It does nothing unless versioning is enabled.
+func (a *adapter) bumpGeneration(ctx context.Context) error {
+	if !a.versioning {
+		return nil
+	}
+	_, err := a.incrementCounter(ctx, "generation", 1)
+	return err
+}
+
+// Generation returns the generation of the stored policy, which is
+// incremented by every write made through an adapter with
+// AdapterConfig.Versioning enabled. It is 0 until the first write.
+func (a *adapter) Generation(ctx context.Context) (generation int64, err error) {
+	defer a.observe("Generation", &err)()
+	defer a.wrapError("Generation", &err)
+
+	ctx, span := a.startSpan(ctx, "Generation")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	return a.generation(ctx)
+}
+
+func (a *adapter) generation(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := a.counters().FindOne(ctx, bson.M{"_id": "generation"}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return counter.Seq, a.commandError("find", a.counters(), err)
+}
+
+// findOptions returns the options used to find the rules to load.
+func (a *adapter) findOptions() *options.FindOptions {
+	findOption := options.Find()
+	if a.preserveOrder {
+		findOption.SetSort(bson.D{{Key: "order", Value: 1}})
+	}
+	if a.stableOrder {
+		// Sorted like the default index over the rule fields.
+		keys := bson.D{}
+		for _, field := range a.ruleFields() {
+			keys = append(keys, bson.E{Key: a.fieldNames.field(field), Value: 1})
+		}
+		findOption.SetSort(keys)
+	}
+	if a.batchSize > 0 {
+		findOption.SetBatchSize(a.batchSize)
+	}
+	return findOption
+}
+
+// aggregateOptions returns the options used to aggregate the rules to load.
+func (a *adapter) aggregateOptions() *options.AggregateOptions {
+	aggregateOption := options.Aggregate()
+	if a.batchSize > 0 {
+		aggregateOption.SetBatchSize(a.batchSize)
+	}
+	return aggregateOption
+}
+
+// replaceLine replaces the rule matching the filter with newLine. When
+// preserveOrder is enabled the rule keeps its place in the insertion order,
+// and when timestamps is enabled its creation time.
+func (a *adapter) replaceLine(ctx context.Context, filter interface{}, newLine CasbinRule) error {
+	a.touch(&newLine)
+	if len(a.shards) > 0 || a.deterministicID {
+		return a.moveLine(ctx, filter, newLine)
+	}
+	if a.preserveOrder || a.timestamps {
+		_, err := a.collection.UpdateOne(ctx, a.active(filter), a.updateLine(newLine))
+		return a.commandError("update", a.collection, err)
+	}
+	_, err := a.collection.ReplaceOne(ctx, a.active(filter), newLine)
+	return a.commandError("update", a.collection, err)
+}
+
+// replaceLines replaces the rule matching every old line with the new line
+// at the same index, like replaceLine, in a single BulkWrite. It runs in a
+// transaction, so that either all or none of the rules are replaced, unless
+// the server doesn't support transactions.
+func (a *adapter) replaceLines(ctx context.Context, oldLines, newLines []CasbinRule) error {
+	if len(newLines) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(newLines))
+	for i := range newLines {
+		newLine := newLines[i]
+		a.touch(&newLine)
+		filter := a.active(oldLines[i])
+		if a.preserveOrder || a.timestamps {
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(a.updateLine(newLine)))
+		} else {
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(newLine))
+		}
+	}
+
+	_, err := a.withTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		_, err := a.collection.BulkWrite(sessionCtx, models)
+		return nil, a.commandError("update", a.collection, err)
+	})
+	if err != nil {
+		// (IllegalOperation) Transaction numbers are only allowed on a replica set member or mongos
+		var mongoErr mongo.CommandError
+		if !errors.As(err, &mongoErr) || mongoErr.Code != 20 {
+			return err
+		}
+
+		log.Println("[WARNING]: As your mongodb server doesn't allow a replica set, transaction operation is not supported. So Casbin Adapter will run non-transactional updating!")
+		_, err = a.collection.BulkWrite(ctx, models)
+		return a.commandError("update", a.collection, err)
+	}
+	return nil
+}
+
+// updateLine returns the update replacing the fields of a stored rule with
+// the ones of newLine, keeping the fields newLine doesn't set, like its order
+// and creation time, but removing the long values it doesn't store apart and
+// the expiry it doesn't have.
+func (a *adapter) updateLine(newLine CasbinRule) bson.M {
+	unset := bson.M{}
+	if newLine.ExpiresAt == nil {
+		unset["expiresAt"] = ""
+	}
+	if a.longValues > 0 {
+		values := append([]string{newLine.V0, newLine.V1, newLine.V2, newLine.V3, newLine.V4, newLine.V5}, newLine.Extra...)
+		for i, value := range values {
+			if len(value) <= a.longValues {
+				unset[fmt.Sprintf("v%d%s", i, longValueSuffix)] = ""
+			}
+		}
+	}
+
+	update := bson.M{"$set": newLine}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// touch sets the update time of a line replacing a stored rule, and clears
+// its creation time so that the one of the stored rule is kept.
+func (a *adapter) touch(line *CasbinRule) {
+	if a.timestamps {
+		now := time.Now()
+		line.CreatedAt = nil
+		line.UpdatedAt = &now
+	}
+}
+
+// softDeleteUpdate marks the rules it updates deleted at the current time of
+// the server.
+var softDeleteUpdate = bson.M{"$currentDate": bson.M{"deletedAt": true}}
+
+// active restricts the filter, a selector or an aggregation pipeline, to the
+// rules not marked deleted when softDelete is enabled.
+func (a *adapter) active(filter interface{}) interface{} {
+	if !a.softDelete {
+		return filter
+	}
+	if pipeline, ok := filter.(mongo.Pipeline); ok {
+		match := bson.D{{Key: "$match", Value: bson.M{"deletedAt": nil}}}
+		return append(mongo.Pipeline{match}, pipeline...)
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"deletedAt": nil}}}
+}
+
+// deleteMany deletes the rules of the collection matching the filter, or
+// marks them deleted with softDelete, and returns their number.
+func (a *adapter) deleteMany(ctx context.Context, collection *mongo.Collection, filter interface{}) (int64, error) {
+	if a.softDelete {
+		result, err := collection.UpdateMany(ctx, a.active(filter), softDeleteUpdate)
+		if err != nil {
+			return 0, a.commandError("update", collection, err)
+		}
+		return result.ModifiedCount, nil
+	}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, a.commandError("delete", collection, err)
+	}
+	return result.DeletedCount, nil
+}
+
+// deleteOne is like deleteMany, but for a single rule.
+func (a *adapter) deleteOne(ctx context.Context, collection *mongo.Collection, filter interface{}) (int64, error) {
+	if a.softDelete {
+		result, err := collection.UpdateOne(ctx, a.active(filter), softDeleteUpdate)
+		if err != nil {
+			return 0, a.commandError("update", collection, err)
+		}
+		return result.ModifiedCount, nil
+	}
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return 0, a.commandError("delete", collection, err)
+	}
+	return result.DeletedCount, nil
+}
+
+// PurgeDeleted deletes the rules marked deleted before the given time with
+// AdapterConfig.SoftDelete.
+func (a *adapter) PurgeDeleted(before time.Time) (err error) {
+	defer a.observe("PurgeDeleted", &err)()
+	defer a.wrapError("PurgeDeleted", &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	for _, collection := range a.collections() {
+		if _, err := collection.DeleteMany(ctx, bson.M{"deletedAt": bson.M{"$lt": before}}); err != nil {
+			return a.commandError("delete", collection, err)
+		}
+	}
+	return nil
+}
+
+// moveLine replaces the rule matching the filter with newLine when the rules
+// are sharded, since newLine may belong to another shard, or when newLine has
+// another _id: the rule is deleted from its shard and newLine inserted into
+// its own. The deleted rule is restored if the insert fails.
+func (a *adapter) moveLine(ctx context.Context, filter interface{}, newLine CasbinRule) error {
+	for _, collection := range a.collections() {
+		oldLine := a.newLine()
+		var err error
+		if a.softDelete {
+			err = collection.FindOneAndUpdate(ctx, a.active(filter), softDeleteUpdate).Decode(&oldLine)
+		} else {
+			err = collection.FindOneAndDelete(ctx, filter).Decode(&oldLine)
+		}
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return a.commandError("findAndModify", collection, err)
+		}
+
+		if a.preserveOrder {
+			newLine.Order = oldLine.Order
+		}
+		if a.timestamps {
+			newLine.CreatedAt = oldLine.CreatedAt
+		}
+		target := a.collectionFor(&newLine)
+		if _, err := target.InsertOne(ctx, newLine); err != nil {
+			var restoreErr error
+			if a.softDelete {
+				_, restoreErr = collection.UpdateByID(ctx, oldLine.ID, bson.M{"$unset": bson.M{"deletedAt": ""}})
+			} else {
+				_, restoreErr = collection.InsertOne(ctx, oldLine)
+			}
+			if restoreErr != nil {
+				log.Printf("[WARNING] failed to restore rule %v: %v", oldLine.toStringPolicy(), restoreErr)
+			}
+			return a.commandError("insert", target, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// ping checks that the server the reads are routed to is reachable.
+func (a *adapter) ping() error {
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	return a.client.Ping(ctx, nil)
+}
+
+// checkDatabaseExists returns ErrDatabaseNotFound if the database of the
+// policy collection doesn't exist.
+func (a *adapter) checkDatabaseExists() error {
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	databaseName := a.collection.Database().Name()
+	names, err := a.client.ListDatabaseNames(ctx, bson.M{"name": databaseName})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%w: %s", ErrDatabaseNotFound, databaseName)
+	}
+	return nil
+}
+
+// shardCollection enables sharding for the database, shards the policy
+// collection and assigns the configured zones.
+func (a *adapter) shardCollection(config *ShardingConfig) error {
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	admin := a.client.Database("admin")
+	databaseName := a.collection.Database().Name()
+	namespace := databaseName + "." + a.collection.Name()
+
+	if err := admin.RunCommand(ctx, bson.D{
+		{Key: "enableSharding", Value: databaseName},
+	}).Err(); err != nil {
+		return err
+	}
+	if err := admin.RunCommand(ctx, bson.D{
+		{Key: "shardCollection", Value: namespace},
+		{Key: "key", Value: config.Key},
+	}).Err(); err != nil {
+		return err
+	}
+
+	for _, zone := range config.Zones {
+		for _, shard := range zone.Shards {
+			if err := admin.RunCommand(ctx, bson.D{
+				{Key: "addShardToZone", Value: shard},
+				{Key: "zone", Value: zone.Name},
+			}).Err(); err != nil {
+				return err
+			}
+		}
+		if err := admin.RunCommand(ctx, bson.D{
+			{Key: "updateZoneKeyRange", Value: namespace},
+			{Key: "min", Value: zone.Min},
+			{Key: "max", Value: zone.Max},
+			{Key: "zone", Value: zone.Name},
+		}).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *adapter) close() error {
+	if !a.ownsClient || a.client == nil || !a.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	return a.client.Disconnect(ctx)
+}
+
+// Close disconnects the client the adapter connected. It doesn't disconnect
+// the client passed to NewAdapterByDB, which is owned by the caller. Calling
+// it more than once is a no-op.
+func (a *adapter) Close() error {
+	runtime.SetFinalizer(a, nil)
+	return a.close()
+}
+
+// Ping checks that the primary of the deployment is reachable, e.g. for a
+// readiness probe. The adapter timeout only applies if ctx has no deadline.
+func (a *adapter) Ping(ctx context.Context) (err error) {
+	defer a.observe("Ping", &err)()
+	defer a.wrapError("Ping", &err)
+
+	ctx, span := a.startSpan(ctx, "Ping")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	return a.client.Ping(ctx, readpref.Primary())
+}
+
+// dropTable removes every stored rule by dropping the collections, or marks
+// them deleted with softDelete.
+func (a *adapter) dropTable(ctx context.Context) error {
+	for _, collection := range a.collections() {
+		if a.softDelete {
+			if _, err := a.deleteMany(ctx, collection, bson.D{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := collection.Drop(ctx); err != nil {
+			return a.commandError("drop", collection, err)
+		}
+	}
+	return nil
+}
+
+// DropPolicyCollection drops the policy collection, permanently deleting
+// every stored rule, even with AdapterConfig.SoftDelete, e.g. to tear down
+// integration tests or reset the policy. The indexes are created again,
+// unless AdapterConfig.SkipIndexCreation is set, so the rules written
+// afterwards are still unique.
+func (a *adapter) DropPolicyCollection(ctx context.Context) (err error) {
+	defer a.observe("DropPolicyCollection", &err)()
+	defer a.wrapError("DropPolicyCollection", &err)
+
+	ctx, span := a.startSpan(ctx, "DropPolicyCollection")
+	defer endSpan(span, &err)
+
+	// The pending indexes are created after the drop.
+	if a.inMaintenance() {
+		return ErrMaintenanceMode
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	for _, collection := range a.collections() {
+		if err := collection.Drop(ctx); err != nil {
+			return a.commandError("drop", collection, err)
+		}
+		if a.skipIndexCreation {
+			continue
+		}
+		if _, err := collection.Indexes().CreateMany(ctx, a.indexModels()); err != nil {
+			return a.commandError("createIndexes", collection, err)
+		}
+	}
+	a.pendingIndexes.Store(false)
+
+	return a.bumpGeneration(ctx)
+}
+
+func loadPolicyLine(line CasbinRule, model model.Model) error {
+	rule := line.rule()
+	if len(rule) == 0 {
+		return nil
+	}
+	lineText := strings.Join(append([]string{line.PType}, rule...), ", ")
+
+	return persist.LoadPolicyLine(lineText, model)
+}
+
+// LoadPolicy loads policy from database.
+func (a *adapter) LoadPolicy(model model.Model) error {
+	return a.LoadPolicyCtx(a.baseContext(), model)
+}
+
+// LoadPolicyCtx loads policy from database. The adapter timeout only applies
+// if ctx has no deadline.
+func (a *adapter) LoadPolicyCtx(ctx context.Context, model model.Model) (err error) {
+	defer a.observe("LoadPolicy", &err)()
+	defer a.wrapError("LoadPolicy", &err)
+
+	ctx, span := a.startSpan(ctx, "LoadPolicy")
+	defer endSpan(span, &err)
+
+	if err := a.loadFilteredPolicy(ctx, model, nil); err != nil {
+		return err
+	}
+	span.SetAttributes(rulesAttribute(modelSize(model)))
+	return nil
+}
+
+// modelSize returns the number of rules of the model.
+func modelSize(model model.Model) int {
+	n := 0
+	for _, sec := range []string{"p", "g"} {
+		for _, ast := range model[sec] {
+			n += len(ast.Policy)
+		}
+	}
+	return n
+}
+
+// FilterOptions wraps a filter passed to LoadFilteredPolicy with options of
+// the query.
+type FilterOptions struct {
+	// Filter is the MongoDB selector or mongo.Pipeline. A nil filter matches
+	// every rule.
+	Filter interface{}
+	// CaseInsensitive matches the values regardless of their case, e.g.
+	// "alice@example.com" and "Alice@example.com", with a collation of
+	// strength 2. MongoDB only uses the indexes created with the same
+	// collation for such queries, so a large policy needs one over the
+	// filtered fields, e.g. {ptype: 1, v0: 1} with the collation
+	// {locale: "en", strength: 2}.
+	CaseInsensitive bool
+	// Locale is the locale of the collation. It defaults to "en".
+	Locale string
+}
+
+// collation returns the collation of the query, if any.
+func (f FilterOptions) collation() *options.Collation {
+	if !f.CaseInsensitive {
+		return nil
+	}
+	locale := f.Locale
+	if locale == "" {
+		locale = "en"
+	}
+	return &options.Collation{Locale: locale, Strength: 2}
+}
+
+// LoadFilteredPolicy loads matching policy lines from database. If not nil,
+// the filter must be a valid MongoDB selector, a mongo.Pipeline whose
+// output documents are rules, e.g. to join the rules against another
+// collection with $lookup, or FilterOptions. The rules are added to the
+// model, skipping the ones it already holds, so that
+// Enforcer.LoadIncrementalFilteredPolicy can accumulate several filtered
+// slices. The policy stays filtered until it is loaded without a filter.
+func (a *adapter) LoadFilteredPolicy(model model.Model, filter interface{}) (err error) {
+	defer a.observe("LoadFilteredPolicy", &err)()
+	defer a.wrapError("LoadFilteredPolicy", &err)
+
+	return a.loadFilteredPolicy(a.baseContext(), model, filter)
+}
+
+// LoadIncrementalFilteredPolicy adds the policy lines matching the filter to
+// the rules the model already holds, e.g. to progressively load the rules of
+// several tenants into one enforcer, calling it once per tenant. The filter
+// is one LoadFilteredPolicy accepts.
+//
+// Casbin only deduplicates the rules added through the enforcer API, not
+// the ones an adapter loads into the model, so the rules the model already
+// holds, e.g. matched by a previous filter, are skipped rather than loaded
+// twice. It only differs from LoadFilteredPolicy for a nil filter, which
+// LoadFilteredPolicy treats as a full load into an empty model: here it
+// matches every rule, still skips the ones already held, and leaves the
+// policy filtered, so SavePolicy can't overwrite the stored policy with
+// what the model holds. Rebuild the role links of an enforcer with
+// Enforcer.BuildRoleLinks afterwards.
+func (a *adapter) LoadIncrementalFilteredPolicy(model model.Model, filter interface{}) (err error) {
+	defer a.observe("LoadIncrementalFilteredPolicy", &err)()
+	defer a.wrapError("LoadIncrementalFilteredPolicy", &err)
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+	return a.loadFilteredPolicy(a.baseContext(), model, filter)
+}
+
+func (a *adapter) loadFilteredPolicy(ctx context.Context, model model.Model, filter interface{}) error {
+	// A filtered load may add to the rules already in the model, e.g. for
+	// Enforcer.LoadIncrementalFilteredPolicy, so it skips them rather than
+	// clearing the model before a retry.
+	var seen map[string]struct{}
+	full := filter == nil
+	if full {
+		filter = bson.D{{}}
+	} else {
+		seen = a.loadedRules(model)
+	}
+
+	err := a.loadWithRetries(ctx, model, filter, seen)
+	// The policy is only unfiltered once fully loaded: the model may hold a
+	// part of it after an error, which SavePolicy must not write.
+	a.filtered = !full || err != nil
+	return err
+}
+
+// loadWithRetries loads the rules matching the filter into the model,
+// retrying on transient errors.
+func (a *adapter) loadWithRetries(ctx context.Context, model model.Model, filter interface{}, seen map[string]struct{}) error {
+	for retry := 0; ; retry++ {
+		err := a.loadPolicyLines(ctx, model, filter, seen, 0)
+		if err == nil && a.validateOnLoad {
+			return validateArity(model)
+		}
+		if err == nil || retry >= a.loadRetries || !isRetryableLoadError(err) {
+			return err
+		}
+		if seen == nil {
+			model.ClearPolicy()
+		}
+	}
+}
+
+// maxArityReports bounds the rules of a ptype listed by validateArity.
+const maxArityReports = 10
+
+// validateArity returns ErrInconsistentArity if the rules of a ptype of the
+// model don't all have the expected number of values: the number of tokens
+// of its definition if any, or else the most common one.
+func validateArity(model model.Model) error {
+	var problems []string
+	for _, sec := range []string{"p", "g"} {
+		ptypes := make([]string, 0, len(model[sec]))
+		for ptype := range model[sec] {
+			ptypes = append(ptypes, ptype)
+		}
+		sort.Strings(ptypes)
+
+		for _, ptype := range ptypes {
+			ast := model[sec][ptype]
+			expected := len(ast.Tokens)
+			if expected == 0 {
+				counts := make(map[int]int)
+				for _, rule := range ast.Policy {
+					counts[len(rule)]++
+					if counts[len(rule)] > counts[expected] || (counts[len(rule)] == counts[expected] && len(rule) < expected) {
+						expected = len(rule)
+					}
+				}
+			}
+
+			reported := 0
+			for i, rule := range ast.Policy {
+				if len(rule) == expected {
+					continue
+				}
+				if reported < maxArityReports {
+					problems = append(problems, fmt.Sprintf("%s rule %d %v has %d values, expected %d", ptype, i, rule, len(rule), expected))
+				}
+				reported++
+			}
+			if reported > maxArityReports {
+				problems = append(problems, fmt.Sprintf("%d more %s rules", reported-maxArityReports, ptype))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInconsistentArity, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// loadedRules returns the keys of the rules already in the model.
+func (a *adapter) loadedRules(model model.Model) map[string]struct{} {
+	seen := make(map[string]struct{})
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				line := a.policyLine(sec, ptype, rule)
+				seen[line.key()] = struct{}{}
+			}
+		}
+	}
+	return seen
+}
+
+// decodeLine decodes the rule stored in doc into line. It returns false if
+// the document is malformed, with the error of onDecodeError, or nil if it
+// skips the document.
+func (a *adapter) decodeLine(doc bson.Raw, line *CasbinRule) (bool, error) {
+	err := bson.Unmarshal(doc, line)
+	if err == nil {
+		return true, nil
+	}
+	if a.onDecodeError == nil {
+		return false, err
+	}
+	return false, a.onDecodeError(doc, err)
+}
+
+// loadLines decodes the rules of the cursor and passes the accepted ones to add.
+func (a *adapter) loadLines(ctx context.Context, cursor *mongo.Cursor, add func(CasbinRule) error) error {
+	for cursor.Next(ctx) {
+		line := a.newLine()
+		if ok, err := a.decodeLine(cursor.Current, &line); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !a.acceptLine(&line) {
+			continue
+		}
+		if err := add(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLinesParallel is like loadLines, but decodes the rules with loadWorkers
+// goroutines while the cursor streams, calling add under a mutex. The first
+// error stops the load.
+func (a *adapter) loadLinesParallel(ctx context.Context, cursor *mongo.Cursor, add func(CasbinRule) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	docs := make(chan bson.Raw, a.loadWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < a.loadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doc := range docs {
+				if ctx.Err() != nil {
+					continue
+				}
+				line := a.newLine()
+				if ok, err := a.decodeLine(doc, &line); !ok {
+					if err != nil {
+						fail(err)
+					}
+					continue
+				}
+				if !a.acceptLine(&line) {
+					continue
+				}
+				mu.Lock()
+				err := add(line)
+				mu.Unlock()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	for cursor.Next(ctx) {
+		// The current document is only valid until the next call.
+		doc := make(bson.Raw, len(cursor.Current))
+		copy(doc, cursor.Current)
+		select {
+		case docs <- doc:
+		case <-ctx.Done():
+		}
+	}
+	close(docs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// isRetryableLoadError returns true if loading the policy from the start again
+// may succeed after err.
+func isRetryableLoadError(err error) bool {
+	var mongoErr mongo.CommandError
+	// (CursorNotFound) cursor id not found
+	if errors.As(err, &mongoErr) && mongoErr.Code == 43 {
+		return true
+	}
+	return mongo.IsNetworkError(err)
+}
+
+// isRetryableWriteError returns true if err is transient, so that the write
+// may succeed when retried.
+func isRetryableWriteError(err error) bool {
+	if err == nil || mongo.IsDuplicateKeyError(err) {
+		return false
+	}
+	if mongo.IsTimeout(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) &&
+		(serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError"))
+}
+
+// retryWrite calls write until it succeeds, fails with an error that isn't
+// transient, or maxRetries retries have been made, waiting a capped
+// exponential backoff between the calls. It doesn't retry within a
+// transaction of the caller, which a transient error aborts: the caller
+// has to retry the whole transaction.
+func (a *adapter) retryWrite(ctx context.Context, write func() error) error {
+	retries := a.maxRetries
+	if inTransaction(mongo.SessionFromContext(ctx)) {
+		retries = 0
+	}
+
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if attempt >= retries || !isRetryableWriteError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// LoadPolicyCapped loads policy from database, loading at most
+// maxRowsPerPType rules of each ptype. When a ptype has more rules, it fails
+// with ErrPolicyTooLarge, leaving the model partially loaded, or, with
+// AdapterConfig.TruncateCapped, logs and skips the extra rules. A truncated
+// or partially loaded policy is treated as filtered, so SavePolicy can't drop
+// the skipped rules.
+func (a *adapter) LoadPolicyCapped(model model.Model, maxRowsPerPType int) (err error) {
+	defer a.observe("LoadPolicyCapped", &err)()
+	defer a.wrapError("LoadPolicyCapped", &err)
+
+	a.filtered = false
+	err = a.loadPolicyLines(a.baseContext(), model, bson.D{{}}, nil, maxRowsPerPType)
+	if err != nil {
+		a.filtered = true
+	}
+	return err
+}
+
+// LoadPolicyIfChanged reloads the whole policy into the model, replacing the
+// policy it holds, only if the generation of the stored policy differs from
+// lastGeneration. It returns the generation of the loaded policy and whether
+// the policy was reloaded. Without AdapterConfig.Versioning the generation is
+// always 0 and the policy is always reloaded.
+func (a *adapter) LoadPolicyIfChanged(model model.Model, lastGeneration int64) (generation int64, reloaded bool, err error) {
+	defer a.observe("LoadPolicyIfChanged", &err)()
+	defer a.wrapError("LoadPolicyIfChanged", &err)
+
+	if !a.versioning {
+		model.ClearPolicy()
+		return 0, true, a.loadFilteredPolicy(a.baseContext(), model, nil)
+	}
+
+	// The generation is read before loading, so a concurrent write can only
+	// cause an extra reload on the next call, never a missed one.
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	generation, err = a.generation(ctx)
+	cancel()
+	if err != nil {
+		return lastGeneration, false, err
+	}
+	if generation == lastGeneration {
+		return generation, false, nil
+	}
+
+	model.ClearPolicy()
+	if err := a.loadFilteredPolicy(a.baseContext(), model, nil); err != nil {
+		return lastGeneration, false, err
+	}
+	return generation, true, nil
+}
+
+// LoadFilteredPoliciesDedup loads the policy lines matching any of the
+// filters in a single query. A rule matched by several filters, or stored
+// more than once, is only loaded once. Each filter must be a valid MongoDB
+// selector.
+func (a *adapter) LoadFilteredPoliciesDedup(model model.Model, filters []interface{}) (err error) {
+	defer a.observe("LoadFilteredPoliciesDedup", &err)()
+	defer a.wrapError("LoadFilteredPoliciesDedup", &err)
+
+	a.filtered = true
+	if len(filters) == 0 {
+		return nil
+	}
+
+	return a.loadPolicyLines(a.baseContext(), model, bson.M{"$or": filters}, make(map[string]struct{}), 0)
+}
+
+// loadPolicyLines loads the policy lines matching the filter into the model.
+// If seen is not nil, lines already in it are skipped and loaded lines are
+// added to it. If maxRowsPerPType is positive, at most that many lines of
+// each ptype are loaded.
+func (a *adapter) loadPolicyLines(ctx context.Context, model model.Model, filter interface{}, seen map[string]struct{}, maxRowsPerPType int) error {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	var rows map[string]int
+	if maxRowsPerPType > 0 {
+		rows = make(map[string]int)
+	}
+	add := func(line CasbinRule) error {
+		if seen != nil {
+			k := line.key()
+			if _, ok := seen[k]; ok {
+				return nil
+			}
+			seen[k] = struct{}{}
+		}
+		if rows != nil {
+			rows[line.PType]++
+			if rows[line.PType] > maxRowsPerPType {
+				if !a.truncateCapped {
+					return fmt.Errorf("%w: more than %d %s rules", ErrPolicyTooLarge, maxRowsPerPType, line.PType)
+				}
+				if rows[line.PType] == maxRowsPerPType+1 {
+					log.Printf("[WARNING]: More than %d %s rules are stored, Casbin Adapter will not load the rest!", maxRowsPerPType, line.PType)
+				}
+				a.filtered = true
+				return nil
+			}
+		}
+		return loadPolicyLine(line, model)
+	}
+
+	if len(a.shards) == 0 {
+		return a.loadCollectionLines(ctx, a.collection, filter, add)
+	}
+	var mu sync.Mutex
+	return a.loadConcurrently(ctx, a.shards, func(ctx context.Context, collection *mongo.Collection) error {
+		return a.loadCollectionLines(ctx, collection, filter, func(line CasbinRule) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return add(line)
+		})
+	})
+}
+
+// loadCollectionLines passes the lines of the collection matching the filter,
+// a selector or an aggregation pipeline, to add.
+func (a *adapter) loadCollectionLines(ctx context.Context, collection *mongo.Collection, filter interface{}, add func(CasbinRule) error) error {
+	if a.loadReadPref != nil {
+		var err error
+		collection, err = collection.Clone(options.Collection().SetReadPreference(a.loadReadPref))
+		if err != nil {
+			return err
+		}
+	}
+
+	findOption := a.findOptions()
+	aggregateOption := a.aggregateOptions()
+	if filterOptions, ok := filter.(FilterOptions); ok {
+		filter = filterOptions.Filter
+		if filter == nil {
+			filter = bson.D{}
+		}
+		if collation := filterOptions.collation(); collation != nil {
+			findOption.SetCollation(collation)
+			aggregateOption.SetCollation(collation)
+		}
+	}
+
+	var cursor *mongo.Cursor
+	var err error
+	command := "find"
+	if pipeline, ok := filter.(mongo.Pipeline); ok {
+		command = "aggregate"
+		cursor, err = collection.Aggregate(ctx, a.active(pipeline), aggregateOption)
+	} else {
+		cursor, err = collection.Find(ctx, a.active(filter), findOption)
+	}
+	if err != nil {
+		return a.commandError(command, collection, err)
+	}
+
+	if a.loadWorkers > 1 {
+		err = a.loadLinesParallel(ctx, cursor, add)
+	} else {
+		err = a.loadLines(ctx, cursor, add)
+	}
+	if err != nil {
+		_ = cursor.Close(ctx)
+		return err
+	}
+	if err := cursor.Err(); err != nil {
+		_ = cursor.Close(ctx)
+		return a.commandError("getMore", collection, err)
+	}
+
+	return a.commandError(command, collection, cursor.Close(ctx))
+}
+
+// acceptLine prepares a line read from the collection to be loaded into the
+// model, and returns false if it must be skipped.
+func (a *adapter) acceptLine(line *CasbinRule) bool {
+	if line.Sec != "" && line.Sec != section(line.PType) {
+		// The rule belongs to a model using the ptype in another section.
+		return false
+	}
+	if a.trimOnLoad {
+		line.trimSpace()
+	}
+	return true
+}
+
+// LoadPolicyFromCollections loads the rules of the collections, of the
+// database of the adapter, into the model. Up to AdapterConfig.LoadConcurrency
+// collections are read at once, so the rules of different collections may be
+// loaded in any order. The loaded policy is treated as filtered, so SavePolicy
+// can't write the merged policy into the collection of the adapter.
+func (a *adapter) LoadPolicyFromCollections(ctx context.Context, model model.Model, collectionNames []string) (err error) {
+	defer a.observe("LoadPolicyFromCollections", &err)()
+	defer a.wrapError("LoadPolicyFromCollections", &err)
+
+	ctx, span := a.startSpan(ctx, "LoadPolicyFromCollections")
+	defer endSpan(span, &err)
+
+	a.filtered = true
+
+	collections := make([]*mongo.Collection, 0, len(collectionNames))
+	for _, name := range collectionNames {
+		collections = append(collections, a.collection.Database().Collection(name))
+	}
+
+	var mu sync.Mutex
+	return a.loadConcurrently(ctx, collections, func(ctx context.Context, collection *mongo.Collection) error {
+		return a.loadCollection(ctx, collection, model, &mu)
+	})
+}
+
+// loadConcurrently calls load for every collection, running up to
+// loadConcurrency calls at once, and returns the first error, which cancels
+// the other calls.
+func (a *adapter) loadConcurrently(ctx context.Context, collections []*mongo.Collection, load func(context.Context, *mongo.Collection) error) (err error) {
+	concurrency := a.loadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	workers := make(chan struct{}, concurrency)
+	for _, collection := range collections {
+		collection := collection
+		workers <- struct{}{}
+		if ctx.Err() != nil {
+			// Another collection failed to load.
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if loadErr := load(ctx, collection); loadErr != nil {
+				once.Do(func() {
+					err = loadErr
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	return err
+}
+
+// loadCollection loads all the rules of the collection into the model,
+// locking mu while modifying the model.
+func (a *adapter) loadCollection(ctx context.Context, collection *mongo.Collection, model model.Model, mu *sync.Mutex) error {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, a.active(bson.D{}), a.findOptions())
+	if err != nil {
+		return a.commandError("find", collection, err)
+	}
+	defer cursor.Close(ctx)
+
+	var lines []CasbinRule
+	for cursor.Next(ctx) {
+		line := a.newLine()
+		if ok, err := a.decodeLine(cursor.Current, &line); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if a.acceptLine(&line) {
+			lines = append(lines, line)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return a.commandError("getMore", collection, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, line := range lines {
+		if err := loadPolicyLine(line, model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMaintenanceMode enables or disables the maintenance mode of the adapter
+// and of its views from WithCollection. While it's enabled, the methods
+// writing the policy fail with ErrMaintenanceMode, so that the writes of the
+// application don't interleave with a bulk operation, which operators run
+// through SaveFromCSVStream. It's safe to call concurrently with the other
+// methods.
+func (a *adapter) SetMaintenanceMode(enabled bool) {
+	a.maintenance.Store(enabled)
+}
+
+// inMaintenance reports whether the maintenance mode is enabled.
+func (a *adapter) inMaintenance() bool {
+	return a.maintenance != nil && a.maintenance.Load()
+}
+
+// checkWritable returns ErrMaintenanceMode if the maintenance mode is enabled.
+// Otherwise, it creates the indexes of a collection selected with
+// WithCollection before its first write.
+func (a *adapter) checkWritable() error {
+	if a.inMaintenance() {
+		return ErrMaintenanceMode
+	}
+	return a.ensureIndexes()
+}
+
+// ensureIndexes creates the indexes if they are pending.
+func (a *adapter) ensureIndexes() error {
+	if !a.pendingIndexes.Load() {
+		return nil
+	}
+	if err := a.prepareIndexes(); err != nil {
+		return err
+	}
+	a.pendingIndexes.Store(false)
+	return nil
+}
+
+// IsFiltered returns true if the loaded policy has been filtered.
+func (a *adapter) IsFiltered() bool {
+	return a.filtered
+}
+
+// Collection returns the collection storing the policy, or the first of the
+// collections with AdapterConfig.ShardCount.
+func (a *adapter) Collection() *mongo.Collection {
+	return a.collection
+}
+
+// WithCollection returns an adapter storing the policy in the named
+// collection of the same database, e.g. to keep the policy of every tenant in
+// its own collection. It shares the client and the configuration of a, but
+// not its loaded state, and it's cheap enough to be created per request. The
+// indexes of the collection are created by its first write. Closing it
+// doesn't disconnect the client.
+func (a *adapter) WithCollection(name string) persist.BatchAdapter {
+	db := a.collection.Database()
+	var shards []*mongo.Collection
+	for i := range a.shards {
+		shards = append(shards, db.Collection(fmt.Sprintf("%s_%d", name, i), a.collectionOption))
+	}
+	collection := db.Collection(name, a.collectionOption)
+	if shards != nil {
+		collection = shards[0]
+	}
+
+	view := &adapter{
+		client:            a.client,
+		collection:        collection,
+		shards:            shards,
+		collectionOption:  a.collectionOption,
+		loadReadPref:      a.loadReadPref,
+		saveTimeout:       a.saveTimeout,
+		ctx:               a.ctx,
+		checkDocumentSize: a.checkDocumentSize,
+		saveConflict:      a.saveConflict,
+		versioning:        a.versioning,
+		wrapErrors:        a.wrapErrors,
+		orderedRemove:     a.orderedRemove,
+		truncateCapped:    a.truncateCapped,
+		storeSection:      a.storeSection,
+		valueColumns:      a.valueColumns,
+		uniqueIndex:       a.uniqueIndex,
+		indexKeys:         a.indexKeys,
+		trimOnLoad:        a.trimOnLoad,
+		preSaveValidate:   a.preSaveValidate,
+		loadRetries:       a.loadRetries,
+		batchSize:         a.batchSize,
+		validateOnLoad:    a.validateOnLoad,
+		softDelete:        a.softDelete,
+		timestamps:        a.timestamps,
+		causalConsistency: a.causalConsistency,
+		fieldTypes:        a.fieldTypes,
+		fieldNames:        a.fieldNames,
+		loadConcurrency:   a.loadConcurrency,
+		loadWorkers:       a.loadWorkers,
+		preserveOrder:     a.preserveOrder,
+		stableOrder:       a.stableOrder,
+		maxRetries:        a.maxRetries,
+		expiryFieldIndex:  a.expiryFieldIndex,
+		skipIndexCreation: a.skipIndexCreation,
+		observer:          a.observer,
+		tracer:            a.tracer,
+		onDecodeError:     a.onDecodeError,
+		deterministicID:   a.deterministicID,
+		longValues:        a.longValues,
+		maxValueLength:    a.maxValueLength,
+		checkKeySize:      a.checkKeySize,
+		maintenance:       a.maintenance,
+	}
+	view.timeout.Store(a.timeout.Load())
+	view.pendingIndexes.Store(!a.skipIndexCreation)
+	return view
+}
+
+// LoadNewRules returns the rules inserted after the one with the sinceID _id,
+// in insertion order, using the _id index. Polling it with the highest ID
+// returned so far, starting from the zero ObjectID, is a cheap way to follow
+// the policy, but it only sees additions: neither removals nor updates are
+// returned. It relies on the _id of the rules being generated ObjectIDs,
+// which are only monotonic across clients with synchronized clocks.
+func (a *adapter) LoadNewRules(ctx context.Context, sinceID primitive.ObjectID) (lines []CasbinRule, err error) {
+	defer a.observe("LoadNewRules", &err)()
+	defer a.wrapError("LoadNewRules", &err)
+
+	if a.deterministicID {
+		return nil, errors.New("LoadNewRules can't be used with DeterministicID")
+	}
+
+	ctx, span := a.startSpan(ctx, "LoadNewRules")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	for _, collection := range a.collections() {
+		newLines, err := a.findLines(ctx, collection, bson.M{"_id": bson.M{"$gt": sinceID}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, newLines...)
+	}
+	if len(a.shards) > 0 {
+		sort.SliceStable(lines, func(i, j int) bool {
+			return bytes.Compare(lines[i].ID[:], lines[j].ID[:]) < 0
+		})
+	}
+	span.SetAttributes(rulesAttribute(len(lines)))
+	return lines, nil
+}
+
+// findLines returns the rules of the collection matching the filter, except
+// the ones marked deleted. The
+// cursor is always closed, and an error closing it is only returned if
+// reading the rules succeeded.
+func (a *adapter) findLines(ctx context.Context, collection *mongo.Collection, filter interface{}, opts ...*options.FindOptions) (lines []CasbinRule, err error) {
+	cursor, err := collection.Find(ctx, a.active(filter), opts...)
+	if err != nil {
+		return nil, a.commandError("find", collection, err)
+	}
+	defer func() {
+		if closeErr := cursor.Close(ctx); closeErr != nil && err == nil {
+			err = a.commandError("killCursors", collection, closeErr)
+		}
+	}()
+
+	for cursor.Next(ctx) {
+		line := a.newLine()
+		if err := cursor.Decode(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, a.commandError("getMore", collection, err)
+	}
+	return lines, nil
+}
+
+// SubjectsWithPermission returns the distinct, sorted subjects (v0) of the
+// "p" rules granting act on obj, without loading the policy. An empty obj or
+// act matches any value.
+func (a *adapter) SubjectsWithPermission(ctx context.Context, obj, act string) (subjects []string, err error) {
+	defer a.observe("SubjectsWithPermission", &err)()
+	defer a.wrapError("SubjectsWithPermission", &err)
+
+	ctx, span := a.startSpan(ctx, "SubjectsWithPermission")
+	defer endSpan(span, &err)
+
+	selector := a.filteredSelector("p", "p", 1, obj, act)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	fields := map[string]interface{}{a.fieldNames.field("v0"): selector}
+	if a.longValues > 0 {
+		// The v0 of a long subject only holds its placeholder.
+		long := "v0" + longValueSuffix
+		fields = map[string]interface{}{
+			a.fieldNames.field("v0"): bson.D{{Key: "$and", Value: bson.A{selector, bson.M{long: bson.M{"$exists": false}}}}},
+			long:                     bson.D{{Key: "$and", Value: bson.A{selector, bson.M{long: bson.M{"$exists": true}}}}},
+		}
+	}
+
+	var values []interface{}
+	for _, collection := range a.collections() {
+		for field, fieldSelector := range fields {
+			collectionValues, err := collection.Distinct(ctx, field, fieldSelector)
+			if err != nil {
+				return nil, a.commandError("distinct", collection, err)
+			}
+			values = append(values, collectionValues...)
+		}
+	}
+
+	subjects = make([]string, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		if t, raw, err := bson.MarshalValue(v); err == nil {
+			if subject, ok := stringValue(bson.RawValue{Type: t, Value: raw}); ok {
+				if _, ok := seen[subject]; ok {
+					// A subject of several shards, or long in some rules.
+					continue
+				}
+				seen[subject] = struct{}{}
+				subjects = append(subjects, subject)
+			}
+		}
+	}
+	sort.Strings(subjects)
+	return subjects, nil
+}
+
+// GetAllPolicies returns the stored rules as they are stored, with their _id,
+// e.g. for an administration interface to edit or remove a specific rule.
+func (a *adapter) GetAllPolicies(ctx context.Context) (lines []CasbinRule, err error) {
+	defer a.observe("GetAllPolicies", &err)()
+	defer a.wrapError("GetAllPolicies", &err)
+
+	ctx, span := a.startSpan(ctx, "GetAllPolicies")
+	defer endSpan(span, &err)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	for _, collection := range a.collections() {
+		collectionLines, err := a.findLines(ctx, collection, bson.D{}, a.findOptions())
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, collectionLines...)
+	}
+	span.SetAttributes(rulesAttribute(len(lines)))
+	return lines, nil
+}
+
+// GetRulesByPType returns the rules matching the filter grouped by ptype,
+// without loading them into a model. If not nil, the filter must be a valid
+// MongoDB selector.
+func (a *adapter) GetRulesByPType(ctx context.Context, filter interface{}) (rules map[string][][]string, err error) {
+	defer a.observe("GetRulesByPType", &err)()
+	defer a.wrapError("GetRulesByPType", &err)
+
+	ctx, span := a.startSpan(ctx, "GetRulesByPType")
+	defer endSpan(span, &err)
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	rules = make(map[string][][]string)
+	for _, collection := range a.collections() {
+		lines, err := a.findLines(ctx, collection, filter, a.findOptions())
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			rules[line.PType] = append(rules[line.PType], line.rule())
+		}
+	}
+
+	return rules, nil
+}
+
+// policyLine builds the line of a rule of the given section.
+func (a *adapter) policyLine(sec string, ptype string, rule []string) CasbinRule {
+	line := savePolicyLine(ptype, rule)
+	if a.storeSection {
+		line.Sec = sec
+	}
+	line.types = a.fieldTypes
+	line.names = a.fieldNames
+	line.longValues = a.longValues
+	if a.expiryFieldIndex > 0 && a.expiryFieldIndex < len(rule) {
+		line.ExpiresAt = parseExpiry(rule[a.expiryFieldIndex])
+	}
+	if a.timestamps {
+		now := time.Now()
+		line.CreatedAt = &now
+	}
+	for i := 6 + len(line.Extra); i < a.valueColumns; i++ {
+		line.Extra = append(line.Extra, "")
+	}
+	if a.deterministicID {
+		line.ID = ruleID(&line)
+	}
+	return line
+}
+
+// ruleID returns the _id derived from the section, ptype and values of the
+// line: the first 12 bytes of their SHA-256 hash.
+func ruleID(line *CasbinRule) primitive.ObjectID {
+	var id primitive.ObjectID
+	sum := sha256.Sum256([]byte(line.key()))
+	copy(id[:], sum[:])
+	return id
+}
+
+// parseExpiry parses an RFC 3339 date-time or a YYYY-MM-DD date, returning nil
+// if the value is empty or malformed.
+func parseExpiry(value string) *time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// newLine returns an empty line stored with the configured field types and
+// names, to decode a rule into.
+func (a *adapter) newLine() CasbinRule {
+	return CasbinRule{types: a.fieldTypes, names: a.fieldNames, longValues: a.longValues}
+}
+
+// section returns the section casbin assigns to the ptype.
+func section(ptype string) string {
+	if ptype == "" {
+		return ""
+	}
+	return ptype[:1]
+}
+
+func savePolicyLine(ptype string, rule []string) CasbinRule {
+	line := CasbinRule{
+		PType: ptype,
+	}
+
+	if len(rule) > 0 {
+		line.V0 = rule[0]
+	}
+	if len(rule) > 1 {
+		line.V1 = rule[1]
+	}
+	if len(rule) > 2 {
+		line.V2 = rule[2]
+	}
+	if len(rule) > 3 {
+		line.V3 = rule[3]
+	}
+	if len(rule) > 4 {
+		line.V4 = rule[4]
+	}
+	if len(rule) > 5 {
+		line.V5 = rule[5]
+	}
+	if len(rule) > 6 {
+		line.Extra = append([]string(nil), rule[6:]...)
+	}
+
+	return line
+}
+
+// policyLines converts all the policy and grouping rules in the model to
+// CasbinRule documents.
+func (a *adapter) policyLines(model model.Model) []CasbinRule {
+	var lines []CasbinRule
+
+	for ptype, ast := range model["p"] {
+		for _, rule := range ast.Policy {
+			lines = append(lines, a.policyLine("p", ptype, rule))
+		}
+	}
+
+	for ptype, ast := range model["g"] {
+		for _, rule := range ast.Policy {
+			lines = append(lines, a.policyLine("g", ptype, rule))
+		}
+	}
+
+	return lines
+}
+
+// diffPolicyLines compares the lines currently stored with the desired lines
+// and returns the lines that need to be inserted and deleted to turn the
+// former into the latter. Duplicated stored lines are deleted.
+func diffPolicyLines(current, desired []CasbinRule) (toInsert, toDelete []CasbinRule) {
+	wanted := make(map[string]struct{}, len(desired))
+	for _, line := range desired {
+		wanted[line.key()] = struct{}{}
+	}
+
+	kept := make(map[string]struct{}, len(current))
+	for _, line := range current {
+		k := line.key()
+		if _, ok := wanted[k]; !ok {
+			toDelete = append(toDelete, line)
+			continue
+		}
+		if _, ok := kept[k]; ok {
+			toDelete = append(toDelete, line)
+			continue
+		}
+		kept[k] = struct{}{}
+	}
+
+	for _, line := range desired {
+		k := line.key()
+		if _, ok := kept[k]; ok {
+			continue
+		}
+		kept[k] = struct{}{}
+		toInsert = append(toInsert, line)
+	}
+
+	return toInsert, toDelete
+}
+
+// DiffAgainstModel compares the policy stored in the database with the policy
+// in the model and returns the rules SavePolicy would insert and delete,
+// without modifying the database. Each rule is prefixed with its ptype.
+func (a *adapter) DiffAgainstModel(ctx context.Context, model model.Model) (toInsert, toDelete [][]string, err error) {
+	defer a.observe("DiffAgainstModel", &err)()
+	defer a.wrapError("DiffAgainstModel", &err)
+
+	ctx, span := a.startSpan(ctx, "DiffAgainstModel")
+	defer endSpan(span, &err)
+
+	if a.filtered {
+		return nil, nil, ErrFilteredSavePolicy
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	var current []CasbinRule
+	for _, collection := range a.collections() {
+		lines, err := a.findLines(ctx, collection, bson.D{})
+		if err != nil {
+			return nil, nil, err
+		}
+		current = append(current, lines...)
+	}
+
+	insertLines, deleteLines := diffPolicyLines(current, a.policyLines(model))
+	for _, line := range insertLines {
+		toInsert = append(toInsert, line.toStringPolicy())
+	}
+	for _, line := range deleteLines {
+		toDelete = append(toDelete, line.toStringPolicy())
+	}
+	return toInsert, toDelete, nil
+}
+
+// SavePolicy saves policy to database.
+func (a *adapter) SavePolicy(model model.Model) error {
+	return a.SavePolicyCtx(a.baseContext(), model)
+}
+
+// SavePolicyCtx saves policy to database. The adapter timeout only applies if
+// ctx has no deadline. Cancelling ctx aborts the save, which then returns an
+// error wrapping context.Canceled. The stored policy is left intact, unless
+// the server doesn't support transactions and the save was cancelled after
+// the stored rules were dropped.
+func (a *adapter) SavePolicyCtx(ctx context.Context, model model.Model) (err error) {
+	defer a.observe("SavePolicy", &err)()
+	defer a.wrapError("SavePolicy", &err)
+
+	ctx, span := a.startSpan(ctx, "SavePolicy")
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	if a.filtered {
+		return ErrFilteredSavePolicy
+	}
+	return a.savePolicy(ctx, model)
+}
+
+// ForceSavePolicy saves the model like SavePolicy, even if the policy is
+// filtered, e.g. once the caller has loaded every slice of the policy with
+// LoadFilteredPolicy. The policy isn't filtered anymore afterwards.
+//
+// It replaces the whole stored policy with the rules of the model: the
+// stored rules that the filters left out of the model are deleted.
+func (a *adapter) ForceSavePolicy(model model.Model) (err error) {
+	defer a.observe("ForceSavePolicy", &err)()
+	defer a.wrapError("ForceSavePolicy", &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := a.savePolicy(a.baseContext(), model); err != nil {
+		return err
+	}
+	a.filtered = false
+	return nil
+}
+
+// savePolicy replaces the stored policy with the rules of the model.
+func (a *adapter) savePolicy(ctx context.Context, model model.Model) (err error) {
+	ruleLines := a.policyLines(model)
+	trace.SpanFromContext(ctx).SetAttributes(rulesAttribute(len(ruleLines)))
+	if err := a.checkLineSizes(ruleLines...); err != nil {
+		return err
+	}
+	if a.preSaveValidate != nil {
+		if err := a.preSaveValidate(ruleLines); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := a.saveContext(ctx)
+	defer cancel()
+	defer func() {
+		err = contextError(ctx, err)
+	}()
+
+	if err := a.assignOrder(ctx, ruleLines); err != nil {
+		return err
+	}
+
+	if err := a.replacePolicyTxn(ctx, ruleLines); err != nil {
+		// (IllegalOperation) Transaction numbers are only allowed on a replica set member or mongos
+		var mongoErr mongo.CommandError
+		if !errors.As(err, &mongoErr) || mongoErr.Code != 20 {
+			return err
+		}
+
+		log.Println("[WARNING]: As your mongodb server doesn't allow a replica set, transaction operation is not supported. So Casbin Adapter will run non-transactional saving!")
+		if err := a.dropTable(ctx); err != nil {
+			return err
+		}
+		if err := a.insertResolvingConflicts(ctx, ruleLines); err != nil {
+			return err
+		}
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// contextError returns err wrapped with the error of ctx if ctx is done, so
+// that errors.Is(err, context.Canceled) holds whichever error the driver
+// returned for the interrupted operation.
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
+
+// withTransaction runs fn in a transaction and returns its result. If the
+// session of ctx, e.g. a mongo.SessionContext passed by the caller, has a
+// transaction in progress, fn runs in it, so that the writes commit or abort
+// with the other writes of the caller. Otherwise, fn runs in a new session
+// with session.WithTransaction, which retries it on transient errors.
+func (a *adapter) withTransaction(ctx context.Context, fn func(sessionCtx mongo.SessionContext) (interface{}, error)) (interface{}, error) {
+	if session := mongo.SessionFromContext(ctx); session != nil && inTransaction(session) {
+		return fn(mongo.NewSessionContext(ctx, session))
+	}
+
+	session, err := a.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(a.baseContext())
+
+	return session.WithTransaction(ctx, fn)
+}
+
+// inTransaction returns true if the session has a transaction in progress.
+func inTransaction(session mongo.Session) bool {
+	// The driver only exposes the state of the transaction through the
+	// session.Client of the session.
+	xs, ok := session.(mongo.XSession)
+	return ok && xs.ClientSession().TransactionRunning()
+}
+
+// replacePolicyTxn replaces the stored rules with the lines in a transaction,
+// so that readers never observe a partially saved policy. The colliding lines
+// are resolved beforehand, since a failed write aborts the transaction.
+func (a *adapter) replacePolicyTxn(ctx context.Context, ruleLines []CasbinRule) error {
+	groups := a.partition(a.resolveConflicts(ruleLines))
+
+	_, err := a.withTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		for i, collection := range a.collections() {
+			// The error of a cancelled context isn't transient, so the
+			// transaction isn't retried.
+			if err := sessionCtx.Err(); err != nil {
+				return nil, err
+			}
+			if _, err := a.deleteMany(sessionCtx, collection, bson.D{}); err != nil {
+				return nil, err
+			}
+			if len(groups[i]) == 0 {
+				continue
+			}
+			var lines []interface{}
+			for _, line := range groups[i] {
+				lines = append(lines, line)
+			}
+			if _, err := collection.InsertMany(sessionCtx, lines); err != nil {
+				return nil, a.commandError("insert", collection, err)
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// resolveConflicts returns the lines without the ones colliding under the
+// unique index, as insertResolvingConflicts would store them: the first of
+// the colliding lines with ConflictKeepFirst, and the last one, at the place
+// of the first, with ConflictMerge. With ConflictError, the lines are
+// returned as is so that the insert fails.
+func (a *adapter) resolveConflicts(lines []CasbinRule) []CasbinRule {
+	if !a.uniqueIndex || a.saveConflict == ConflictError {
+		return lines
+	}
+
+	resolved := make([]CasbinRule, 0, len(lines))
+	indexes := make(map[string]int, len(lines))
+	for _, line := range lines {
+		k := a.indexKey(line)
+		if i, ok := indexes[k]; ok {
+			if a.saveConflict == ConflictMerge {
+				resolved[i] = line
+			}
+			continue
+		}
+		indexes[k] = len(resolved)
+		resolved = append(resolved, line)
+	}
+	return resolved
+}
+
+// indexKey returns the values of the line covered by the unique index.
+func (a *adapter) indexKey(line CasbinRule) string {
+	if len(a.indexKeys) > 0 {
+		all := append([]string{line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}, line.Extra...)
+		values := make([]string, 0, len(a.indexKeys))
+		for _, key := range a.indexKeys {
+			switch key {
+			case "sec":
+				values = append(values, line.Sec)
+			case "ptype":
+				values = append(values, line.PType)
+			default:
+				if i, _ := valueIndex(key); i < len(all) {
+					values = append(values, all[i])
+				} else {
+					values = append(values, "")
+				}
+			}
+		}
+		return strings.Join(values, "\x00")
+	}
+	values := []string{line.Sec, line.PType, line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
+	for i := 6; i < a.valueColumns && i-6 < len(line.Extra); i++ {
+		values = append(values, line.Extra[i-6])
+	}
+	return strings.Join(values, "\x00")
+}
+
+// collections returns the collections storing the rules: the shards with
+// ShardCount, or the policy collection.
+func (a *adapter) collections() []*mongo.Collection {
+	if len(a.shards) > 0 {
+		return a.shards
+	}
+	return []*mongo.Collection{a.collection}
+}
+
+// shardOf returns the index, in collections, of the collection storing the
+// line. Lines colliding under the unique index are stored in the same one.
+func (a *adapter) shardOf(line *CasbinRule) int {
+	if len(a.shards) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(a.indexKey(*line)))
+	return int(h.Sum32() % uint32(len(a.shards)))
+}
+
+// collectionFor returns the collection storing the line.
+func (a *adapter) collectionFor(line *CasbinRule) *mongo.Collection {
+	return a.collections()[a.shardOf(line)]
+}
+
+// partition groups the lines by the collection storing them, in the order of
+// collections, keeping their relative order.
+func (a *adapter) partition(lines []CasbinRule) [][]CasbinRule {
+	groups := make([][]CasbinRule, len(a.collections()))
+	for _, line := range lines {
+		i := a.shardOf(&line)
+		groups[i] = append(groups[i], line)
+	}
+	return groups
+}
+
+// insertResolvingConflicts inserts the lines in order, resolving the
+// duplicate key errors according to saveConflict.
+func (a *adapter) insertResolvingConflicts(ctx context.Context, ruleLines []CasbinRule) error {
+	// Colliding lines are stored in the same collection, so the conflicts
+	// of each collection can be resolved separately.
+	for i, group := range a.partition(ruleLines) {
+		if err := a.insertResolvingConflictsInto(ctx, a.collections()[i], group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *adapter) insertResolvingConflictsInto(ctx context.Context, collection *mongo.Collection, ruleLines []CasbinRule) error {
+	var lines []interface{}
+	for i := range ruleLines {
+		lines = append(lines, &ruleLines[i])
+	}
+
+	for len(lines) > 0 {
+		_, err := collection.InsertMany(ctx, lines)
+		if err == nil || a.saveConflict == ConflictError {
+			return a.commandError("insert", collection, err)
+		}
+		index, ok := duplicateKeyIndex(err)
+		if !ok {
+			return a.commandError("insert", collection, err)
+		}
+		if a.saveConflict == ConflictMerge {
+			line := *lines[index].(*CasbinRule)
+			selector := line.selector()
+			if _, err := collection.ReplaceOne(ctx, a.active(selector), line); err != nil {
+				return a.commandError("update", collection, err)
+			}
+		}
+		lines = lines[index+1:]
+	}
+
+	return nil
+}
+
+// duplicateKeyIndex returns the index of the document an ordered insert
+// stopped at because of a duplicate key error.
+func duplicateKeyIndex(err error) (int, bool) {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) != 1 {
+		return 0, false
+	}
+	writeErr := bulkErr.WriteErrors[0]
+	// (DuplicateKey) E11000 duplicate key error
+	if writeErr.Code != 11000 {
+		return 0, false
+	}
+	return writeErr.Index, true
+}
+
+// SaveFromCSVStream reads policy lines in the Casbin CSV format (e.g.
+// "p, alice, data1, read") from r and inserts them in batches as they are
+// read, so huge policies can be seeded with bounded memory. Quoted values
+// may contain commas. If clearFirst is true, the existing rules are deleted
+// before the first batch is inserted.
+func (a *adapter) SaveFromCSVStream(ctx context.Context, r io.Reader, clearFirst bool) (err error) {
+	defer a.observe("SaveFromCSVStream", &err)()
+	defer a.wrapError("SaveFromCSVStream", &err)
+
+	ctx, span := a.startSpan(ctx, "SaveFromCSVStream")
+	defer endSpan(span, &err)
+
+	// The maintenance mode doesn't apply to the bulk writes.
+	if err := a.ensureIndexes(); err != nil {
+		return err
+	}
+
+	if clearFirst {
+		clearCtx, cancel := a.timeoutContext(ctx)
+		defer cancel()
+		for _, collection := range a.collections() {
+			if _, err := a.deleteMany(clearCtx, collection, bson.D{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	batch := make([]CasbinRule, 0, csvBatchSize)
+	for {
+		record, err := reader.Read()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if record != nil {
+			for i := range record {
+				record[i] = strings.TrimSpace(record[i])
+			}
+			batch = append(batch, a.policyLine(section(record[0]), record[0], record[1:]))
+		}
+		if len(batch) == csvBatchSize || (err == io.EOF && len(batch) > 0) {
+			if err := a.insertBatch(ctx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			ctx, cancel := a.timeoutContext(ctx)
+			defer cancel()
+			return a.bumpGeneration(ctx)
+		}
+	}
+}
+
+// insertBatch inserts the lines with a single InsertMany per collection.
+func (a *adapter) insertBatch(ctx context.Context, batch []CasbinRule) error {
+	if err := a.checkLineSizes(batch...); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	if err := a.assignOrder(ctx, batch); err != nil {
+		return err
+	}
+	for i, group := range a.partition(batch) {
+		if len(group) == 0 {
+			continue
+		}
+		lines := make([]interface{}, 0, len(group))
+		for _, line := range group {
+			lines = append(lines, line)
+		}
+		collection := a.collections()[i]
+		if _, err := collection.InsertMany(ctx, lines); err != nil {
+			return a.commandError("insert", collection, err)
+		}
+	}
+	return nil
+}
+
+// AddPolicy adds a policy rule to the storage.
+func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.AddPolicyCtx(a.baseContext(), sec, ptype, rule)
+}
+
+// AddPolicyCtx adds a policy rule to the storage. The adapter timeout only
+// applies if ctx has no deadline.
+func (a *adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) (err error) {
+	defer a.observe("AddPolicy", &err)()
+	defer a.wrapError("AddPolicy", &err)
+
+	ctx, span := a.startSpan(ctx, "AddPolicy", ptypeAttribute(ptype), rulesAttribute(1))
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	lines := []CasbinRule{a.policyLine(sec, ptype, rule)}
+	if err := a.checkLineSizes(lines...); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	if err := a.assignOrder(ctx, lines); err != nil {
+		return err
+	}
+	collection := a.collectionFor(&lines[0])
+	err = a.retryWrite(ctx, func() error {
+		_, err := collection.InsertOne(ctx, lines[0])
+		return err
+	})
+	if err != nil {
+		return a.commandError("insert", collection, err)
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// UpsertPolicy adds a policy rule to the storage unless it's already stored,
+// in which case it does nothing, so it never fails with a duplicate key error.
+func (a *adapter) UpsertPolicy(sec string, ptype string, rule []string) (err error) {
+	defer a.observe("UpsertPolicy", &err)()
+	defer a.wrapError("UpsertPolicy", &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	line := a.policyLine(sec, ptype, rule)
+	if err := a.checkLineSizes(line); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+
+	if err := a.assignOrder(ctx, []CasbinRule{line}); err != nil {
+		return err
+	}
+	selector := a.active(line.selector())
+	collection := a.collectionFor(&line)
+
+	err = a.retryWrite(ctx, func() error {
+		if a.preserveOrder || a.timestamps {
+			// A stored rule keeps its place in the insertion order, and
+			// its creation time.
+			onInsert := bson.M{}
+			if a.preserveOrder {
+				onInsert["order"] = line.Order
+			}
+			if line.ExpiresAt != nil {
+				onInsert["expiresAt"] = line.ExpiresAt
+			}
+			if line.CreatedAt != nil {
+				onInsert["createdAt"] = line.CreatedAt
+			}
+			_, err := collection.UpdateOne(ctx, selector,
+				bson.M{"$setOnInsert": onInsert},
+				options.Update().SetUpsert(true),
+			)
+			return err
+		}
+		_, err := collection.ReplaceOne(ctx, selector, line, options.Replace().SetUpsert(true))
+		return err
+	})
+	if err != nil {
+		return a.commandError("update", collection, err)
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// AddPolicies adds policy rules to the storage, in a single ordered
+// InsertMany round-trip. A duplicate rule aborts the call, but the rules
+// preceding it remain inserted.
+func (a *adapter) AddPolicies(sec string, ptype string, rules [][]string) (err error) {
+	defer a.observe("AddPolicies", &err)()
+	defer a.wrapError("AddPolicies", &err)
+
+	_, err = a.addPolicies(a.baseContext(), sec, ptype, rules)
+	return err
+}
+
+// AddPoliciesCount is like AddPolicies, but also returns the number of rules
+// inserted, including on failure.
+func (a *adapter) AddPoliciesCount(ctx context.Context, sec string, ptype string, rules [][]string) (inserted int64, err error) {
+	defer a.observe("AddPoliciesCount", &err)()
+	defer a.wrapError("AddPoliciesCount", &err)
+
+	ctx, span := a.startSpan(ctx, "AddPoliciesCount", ptypeAttribute(ptype), rulesAttribute(len(rules)))
+	defer endSpan(span, &err)
+
+	return a.addPolicies(ctx, sec, ptype, rules)
+}
+
+// addPolicies inserts the rules and returns the number of rules inserted.
+func (a *adapter) addPolicies(ctx context.Context, sec string, ptype string, rules [][]string) (int64, error) {
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	ruleLines := make([]CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		ruleLines = append(ruleLines, a.policyLine(sec, ptype, rule))
+	}
+	if err := a.checkLineSizes(ruleLines...); err != nil {
+		return 0, err
+	}
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+	if err := a.assignOrder(ctx, ruleLines); err != nil {
+		return 0, err
+	}
+	var inserted int64
+	for i, group := range a.partition(ruleLines) {
+		if len(group) == 0 {
+			continue
+		}
+		collection := a.collections()[i]
+		var lines []interface{}
+		for _, line := range group {
+			lines = append(lines, line)
+		}
+		err := a.retryWrite(ctx, func() error {
+			_, err := collection.InsertMany(ctx, lines)
+			return err
+		})
+		if err != nil {
+			// The insert is ordered, so it stopped at the first failed rule.
+			var bulkErr mongo.BulkWriteException
+			if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+				inserted += int64(bulkErr.WriteErrors[0].Index)
+			}
+			return inserted, a.commandError("insert", collection, err)
+		}
+		inserted += int64(len(lines))
+	}
+	return inserted, a.bumpGeneration(ctx)
+}
+
+// AddPoliciesWithOptions adds policy rules to the storage. If ordered, it
+// behaves like AddPolicies, stopping at the first rule that fails. Otherwise
+// it inserts every rule it can, skipping the ones already stored, and returns
+// a *BulkWriteError telling the inserted rules from the duplicate and failed
+// ones if any rule wasn't inserted.
+func (a *adapter) AddPoliciesWithOptions(sec string, ptype string, rules [][]string, ordered bool) (err error) {
+	defer a.observe("AddPoliciesWithOptions", &err)()
+	defer a.wrapError("AddPoliciesWithOptions", &err)
+
+	if ordered {
+		_, err = a.addPolicies(a.baseContext(), sec, ptype, rules)
+		return err
+	}
+	return a.addPoliciesUnordered(a.baseContext(), sec, ptype, rules)
+}
+
+// addPoliciesUnordered inserts the rules with unordered InsertMany calls.
+func (a *adapter) addPoliciesUnordered(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	ruleLines := make([]CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		ruleLines = append(ruleLines, a.policyLine(sec, ptype, rule))
+	}
+	if err := a.checkLineSizes(ruleLines...); err != nil {
+		return err
+	}
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+	if err := a.assignOrder(ctx, ruleLines); err != nil {
+		return err
+	}
+
+	// The indexes of the rules stored in each collection, to report the
+	// rules as passed.
+	groups := make([][]int, len(a.collections()))
+	for i := range ruleLines {
+		shard := a.shardOf(&ruleLines[i])
+		groups[shard] = append(groups[shard], i)
+	}
+
+	result := &BulkWriteError{}
+	for shard, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		collection := a.collections()[shard]
+		lines := make([]interface{}, 0, len(group))
+		for _, i := range group {
+			lines = append(lines, ruleLines[i])
+		}
+
+		// The insert isn't retried, since the rules inserted by a failed
+		// attempt would then be reported as duplicates.
+		failed := make(map[int]bool)
+		_, err := collection.InsertMany(ctx, lines, options.InsertMany().SetOrdered(false))
+		if err != nil {
+			var bulkErr mongo.BulkWriteException
+			if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+				return a.commandError("insert", collection, err)
+			}
+			for _, writeErr := range bulkErr.WriteErrors {
+				failed[writeErr.Index] = true
+				rule := rules[group[writeErr.Index]]
+				// (DuplicateKey) E11000 duplicate key error
+				if writeErr.Code == 11000 {
+					result.Duplicates = append(result.Duplicates, rule)
+					continue
+				}
+				result.Failed = append(result.Failed, rule)
+				if result.Err == nil {
+					result.Err = a.commandError("insert", collection, writeErr)
+				}
+			}
+		}
+		for j, i := range group {
+			if !failed[j] {
+				result.Inserted = append(result.Inserted, rules[i])
+			}
+		}
+	}
+
+	if len(result.Inserted) > 0 {
+		if err := a.bumpGeneration(ctx); err != nil {
+			return err
+		}
+	}
+	if len(result.Duplicates) > 0 || len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// AddPolicyWithQuota adds a policy rule to the storage, unless its subject (the
+// first value of the rule) already has maxPerSubject rules of the same ptype,
+// in which case ErrQuotaExceeded is returned. The subject must not be empty,
+// and maxPerSubject must be positive. The count and the insert run in a
+// single transaction, so it requires a replica set or a sharded cluster.
+func (a *adapter) AddPolicyWithQuota(ctx context.Context, ptype string, rule []string, maxPerSubject int) (err error) {
+	defer a.observe("AddPolicyWithQuota", &err)()
+	defer a.wrapError("AddPolicyWithQuota", &err)
+
+	ctx, span := a.startSpan(ctx, "AddPolicyWithQuota", ptypeAttribute(ptype), rulesAttribute(1))
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	if maxPerSubject <= 0 {
+		return fmt.Errorf("invalid quota %d, expected a positive number of rules", maxPerSubject)
+	}
+	// An empty subject would match the rules of every subject.
+	if len(rule) == 0 || rule[0] == "" {
+		return errors.New("rule must have a subject")
+	}
+	line := a.policyLine(section(ptype), ptype, rule)
+	if err := a.checkLineSizes(line); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	if err := a.assignOrder(ctx, []CasbinRule{line}); err != nil {
+		return err
+	}
+
+	_, err = a.withTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		// Two transactions counting the same subject don't conflict with each
+		// other, so both writing this document makes one of them retry.
+		quotaID := "quota\x00" + line.Sec + "\x00" + ptype + "\x00" + line.V0
+		_, err := a.counters().UpdateOne(sessionCtx,
+			bson.M{"_id": quotaID},
+			bson.M{"$inc": bson.M{"seq": 1}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return nil, a.commandError("update", a.counters(), err)
+		}
+
+		var count int64
+		for _, collection := range a.collections() {
+			n, err := collection.CountDocuments(sessionCtx, a.filteredSelector(line.Sec, ptype, 0, line.V0))
+			if err != nil {
+				return nil, a.commandError("count", collection, err)
+			}
+			count += n
+		}
+		if count >= int64(maxPerSubject) {
+			return nil, fmt.Errorf("%w: %q already has %d %s rules", ErrQuotaExceeded, line.V0, count, ptype)
+		}
+
+		collection := a.collectionFor(&line)
+		if _, err := collection.InsertOne(sessionCtx, line); err != nil {
+			return nil, a.commandError("insert", collection, err)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// RemovePolicies removes policy rules from the storage.
+func (a *adapter) RemovePolicies(sec string, ptype string, rules [][]string) (err error) {
+	defer a.observe("RemovePolicies", &err)()
+	defer a.wrapError("RemovePolicies", &err)
+
+	_, err = a.removePolicies(a.baseContext(), sec, ptype, rules)
+	return err
+}
+
+// RemovePoliciesCount is like RemovePolicies, but also returns the number of
+// rules deleted. Rules absent from the storage aren't counted.
+func (a *adapter) RemovePoliciesCount(ctx context.Context, sec string, ptype string, rules [][]string) (deleted int64, err error) {
+	defer a.observe("RemovePoliciesCount", &err)()
+	defer a.wrapError("RemovePoliciesCount", &err)
+
+	ctx, span := a.startSpan(ctx, "RemovePoliciesCount", ptypeAttribute(ptype), rulesAttribute(len(rules)))
+	defer endSpan(span, &err)
+
+	return a.removePolicies(ctx, sec, ptype, rules)
+}
+
+// removePolicies deletes the rules and returns the number of rules deleted.
+func (a *adapter) removePolicies(ctx context.Context, sec string, ptype string, rules [][]string) (int64, error) {
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if len(rules) == 0 {
+		return 0, nil
+	}
+
+	// Every value column is stored, even if empty, so each line matches
+	// exactly the documents storing the rule.
+	lines := make([]CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		lines = append(lines, a.policyLine(sec, ptype, rule).selector())
+	}
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	var deleted int64
+	for i, group := range a.partition(lines) {
+		if len(group) == 0 {
+			continue
+		}
+		n, err := a.removeLines(ctx, a.collections()[i], group)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, a.bumpGeneration(ctx)
+}
+
+// removeLines deletes the documents matching the lines from the collection,
+// and returns the number of documents deleted.
+func (a *adapter) removeLines(ctx context.Context, collection *mongo.Collection, lines []CasbinRule) (int64, error) {
+	if a.orderedRemove {
+		var models []mongo.WriteModel
+		for _, line := range lines {
+			if a.softDelete {
+				models = append(models, mongo.NewUpdateOneModel().SetFilter(a.active(line)).SetUpdate(softDeleteUpdate))
+			} else {
+				models = append(models, mongo.NewDeleteOneModel().SetFilter(line))
+			}
+		}
+		var deleted int64
+		result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+		if result != nil {
+			deleted = result.DeletedCount + result.ModifiedCount
+		}
+		return deleted, a.commandError("delete", collection, err)
+	}
+
+	var deleted int64
+	err := a.retryWrite(ctx, func() (err error) {
+		deleted, err = a.deleteMany(ctx, collection, bson.M{"$or": lines})
+		return err
+	})
+	return deleted, err
+}
+
+// RemovePolicy removes a policy rule from the storage.
+func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.RemovePolicyCtx(a.baseContext(), sec, ptype, rule)
+}
+
+// RemovePolicyCtx removes a policy rule from the storage. The adapter timeout
+// only applies if ctx has no deadline.
+func (a *adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) (err error) {
+	defer a.observe("RemovePolicy", &err)()
+	defer a.wrapError("RemovePolicy", &err)
+
+	ctx, span := a.startSpan(ctx, "RemovePolicy", ptypeAttribute(ptype), rulesAttribute(1))
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := a.removeRule(ctx, sec, ptype, rule); err != nil {
+		return err
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// RemovePolicyStrict is like RemovePolicy, but returns ErrPolicyNotFound when
+// the storage has no such rule, e.g. for reconciliation tools to detect that
+// the storage drifted from the model.
+func (a *adapter) RemovePolicyStrict(sec string, ptype string, rule []string) (err error) {
+	defer a.observe("RemovePolicyStrict", &err)()
+	defer a.wrapError("RemovePolicyStrict", &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.withTimeout(a.baseContext())
+	defer cancel()
+
+	deleted, err := a.removeRule(ctx, sec, ptype, rule)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrPolicyNotFound
+	}
+
+	return a.bumpGeneration(ctx)
+}
+
+// removeRule deletes a single document storing the rule, and returns the
+// number of documents deleted.
+func (a *adapter) removeRule(ctx context.Context, sec string, ptype string, rule []string) (int64, error) {
+	line := a.policyLine(sec, ptype, rule).selector()
+	collection := a.collectionFor(&line)
+
+	var deleted int64
+	err := a.retryWrite(ctx, func() (err error) {
+		deleted, err = a.deleteOne(ctx, collection, line)
+		return err
+	})
+	return deleted, err
+}
+
+// selectorValue returns the value of the field at index converted to its BSON
+// type, or as is if it can't be converted and so matches no rule. A long value
+// is replaced by its placeholder.
+func (a *adapter) selectorValue(index int, value string) interface{} {
+	if a.longValues > 0 && len(value) > a.longValues {
+		return longValuePlaceholder(value)
+	}
+	if a.fieldTypes[index] == BSONString {
+		return value
+	}
+	key := fmt.Sprintf("v%d", index)
+	element, err := appendValue(nil, key, a.fieldTypes[index], value)
+	if err != nil {
+		return value
+	}
+	return bson.RawElement(element).Value()
+}
+
+// Filter returns the selector matching the rules of the ptype whose values,
+// starting at fieldIndex, equal fieldValues, as RemoveFilteredPolicy and
+// UpdateFilteredPolicies build it, e.g. to pass to LoadFilteredPolicy. Empty
+// values match any value, and EmptyValue matches empty or missing values.
+// Values at negative indexes are ignored. The selector refers to the default
+// field names, and doesn't match on the section of the rules (StoreSection).
+func Filter(ptype string, fieldIndex int, fieldValues ...string) bson.M {
+	return (&adapter{}).filteredSelector("", ptype, fieldIndex, fieldValues...)
+}
+
+// filteredSelector builds the selector matching the rules of the given section
+// and ptype whose fields, starting at fieldIndex, equal fieldValues. Empty
+// values match any value, and EmptyValue matches empty or missing values.
+func (a *adapter) filteredSelector(sec string, ptype string, fieldIndex int, fieldValues ...string) bson.M {
+	selector := make(bson.M)
+	if a.storeSection {
+		selector["sec"] = sec
+	}
+	if a.softDelete {
+		selector["deletedAt"] = nil
+	}
+	selector[a.fieldNames.field("ptype")] = ptype
+
+	for i, value := range fieldValues {
+		if fieldIndex+i < 0 || value == "" {
+			continue
+		}
+		key := a.fieldNames.field(fmt.Sprintf("v%d", fieldIndex+i))
+		if value == EmptyValue {
+			selector[key] = bson.M{"$in": bson.A{"", nil}}
+		} else {
+			selector[key] = a.selectorValue(fieldIndex+i, value)
+		}
+	}
+
+	return selector
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
+// Empty field values match any value, and EmptyValue only empty values.
+func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) (err error) {
+	defer a.observe("RemoveFilteredPolicy", &err)()
+	defer a.wrapError("RemoveFilteredPolicy", &err)
+
+	_, err = a.removeFilteredPolicy(a.baseContext(), sec, ptype, fieldIndex, fieldValues...)
+	return err
+}
+
+// RemoveFilteredPolicyCount is like RemoveFilteredPolicy, but also returns
+// the number of rules deleted, e.g. to detect a filter matching no rule.
+func (a *adapter) RemoveFilteredPolicyCount(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) (deleted int64, err error) {
+	defer a.observe("RemoveFilteredPolicyCount", &err)()
+	defer a.wrapError("RemoveFilteredPolicyCount", &err)
+
+	ctx, span := a.startSpan(ctx, "RemoveFilteredPolicyCount", ptypeAttribute(ptype))
+	defer endSpan(span, &err)
+
+	deleted, err = a.removeFilteredPolicy(ctx, sec, ptype, fieldIndex, fieldValues...)
+	span.SetAttributes(rulesAttribute(int(deleted)))
+	return deleted, err
+}
+
+// removeFilteredPolicy deletes the rules matching the filter and returns the
+// number of rules deleted.
+func (a *adapter) removeFilteredPolicy(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	selector := a.filteredSelector(sec, ptype, fieldIndex, fieldValues...)
+
+	ctx, cancel := a.timeoutContext(ctx)
 	defer cancel()
 
-	_ = a.client.Disconnect(ctx)
+	return a.removeSelected(ctx, selector)
 }
 
-func (a *adapter) dropTable() error {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
+// RemoveFilteredPolicyAllTypes is like RemoveFilteredPolicy, but removes the
+// matching rules of every ptype in a single deletion, e.g. both the policy and
+// the grouping rules of a deleted user with fieldIndex 0. Since it would
+// remove the whole policy otherwise, one of the field values must not be
+// empty.
+func (a *adapter) RemoveFilteredPolicyAllTypes(ctx context.Context, fieldIndex int, fieldValues ...string) (err error) {
+	defer a.observe("RemoveFilteredPolicyAllTypes", &err)()
+	defer a.wrapError("RemoveFilteredPolicyAllTypes", &err)
 
-	err := a.collection.Drop(ctx)
-	if err != nil {
+	ctx, span := a.startSpan(ctx, "RemoveFilteredPolicyAllTypes")
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
 		return err
 	}
-	return nil
-}
 
-func loadPolicyLine(line CasbinRule, model model.Model) error {
-	var p = []string{line.PType,
-		line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
-	var lineText string
-	if line.V5 != "" {
-		lineText = strings.Join(p, ", ")
-	} else if line.V4 != "" {
-		lineText = strings.Join(p[:6], ", ")
-	} else if line.V3 != "" {
-		lineText = strings.Join(p[:5], ", ")
-	} else if line.V2 != "" {
-		lineText = strings.Join(p[:4], ", ")
-	} else if line.V1 != "" {
-		lineText = strings.Join(p[:3], ", ")
-	} else if line.V0 != "" {
-		lineText = strings.Join(p[:2], ", ")
+	filtered := false
+	for i, value := range fieldValues {
+		if fieldIndex+i >= 0 && value != "" {
+			filtered = true
+		}
+	}
+	if !filtered {
+		return errors.New("no field value to filter the rules")
 	}
 
-	return persist.LoadPolicyLine(lineText, model)
+	selector := a.filteredSelector("", "", fieldIndex, fieldValues...)
+	delete(selector, "sec")
+	delete(selector, a.fieldNames.field("ptype"))
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	deleted, err := a.removeSelected(ctx, selector)
+	span.SetAttributes(rulesAttribute(int(deleted)))
+	return err
 }
 
-// LoadPolicy loads policy from database.
-func (a *adapter) LoadPolicy(model model.Model) error {
-	return a.LoadFilteredPolicy(model, nil)
+// removeSelected deletes the rules matching the selector from every
+// collection and returns the number of rules deleted.
+func (a *adapter) removeSelected(ctx context.Context, selector bson.M) (int64, error) {
+	// The filter doesn't tell which shard stores the matching rules.
+	var deleted int64
+	for _, collection := range a.collections() {
+		var n int64
+		err := a.retryWrite(ctx, func() (err error) {
+			n, err = a.deleteMany(ctx, collection, selector)
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	return deleted, a.bumpGeneration(ctx)
 }
 
-// LoadFilteredPolicy loads matching policy lines from database. If not nil,
-// the filter must be a valid MongoDB selector.
-func (a *adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
-	if filter == nil {
-		a.filtered = false
-		filter = bson.D{{}}
-	} else {
-		a.filtered = true
+// RemoveFilteredPolicyReturning is like RemoveFilteredPolicy, but returns the
+// removed rules, e.g. for audit logging. The rules are read and removed in a
+// transaction, so the returned rules are exactly the removed ones. Without a
+// replica set, it falls back to removing the rules read by _id, which
+// leaves the rules added in between in place.
+func (a *adapter) RemoveFilteredPolicyReturning(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) (removed [][]string, err error) {
+	defer a.observe("RemoveFilteredPolicyReturning", &err)()
+	defer a.wrapError("RemoveFilteredPolicyReturning", &err)
+
+	ctx, span := a.startSpan(ctx, "RemoveFilteredPolicyReturning", ptypeAttribute(ptype))
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	selector := a.filteredSelector(section(ptype), ptype, fieldIndex, fieldValues...)
+
+	ctx, cancel := a.timeoutContext(ctx)
 	defer cancel()
 
-	cursor, err := a.collection.Find(ctx, filter)
+	result, err := a.withTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return a.removeMatching(sessionCtx, selector)
+	})
+	var lines []CasbinRule
 	if err != nil {
-		return err
-	}
-
-	for cursor.Next(ctx) {
-		line := CasbinRule{}
-		err := cursor.Decode(&line)
-		if err != nil {
-			return err
+		// (IllegalOperation) Transaction numbers are only allowed on a replica set member or mongos
+		var mongoErr mongo.CommandError
+		if !errors.As(err, &mongoErr) || mongoErr.Code != 20 {
+			return nil, err
 		}
-		err = loadPolicyLine(line, model)
-		if err != nil {
-			return err
+
+		log.Println("[WARNING]: As your mongodb server doesn't allow a replica set, transaction operation is not supported. So Casbin Adapter will run non-transactional removal!")
+		if lines, err = a.removeMatching(ctx, selector); err != nil {
+			return nil, err
 		}
+	} else {
+		lines = result.([]CasbinRule)
 	}
 
-	return cursor.Close(ctx)
-}
+	if err := a.bumpGeneration(ctx); err != nil {
+		return nil, err
+	}
 
-// IsFiltered returns true if the loaded policy has been filtered.
-func (a *adapter) IsFiltered() bool {
-	return a.filtered
+	removed = make([][]string, 0, len(lines))
+	for _, line := range lines {
+		removed = append(removed, line.toStringPolicy())
+	}
+	return removed, nil
 }
 
-func savePolicyLine(ptype string, rule []string) CasbinRule {
-	line := CasbinRule{
-		PType: ptype,
+// removeMatching removes the rules matching the selector, and returns them.
+func (a *adapter) removeMatching(ctx context.Context, selector map[string]interface{}) ([]CasbinRule, error) {
+	var lines []CasbinRule
+	for _, collection := range a.collections() {
+		removed, err := a.removeMatchingFrom(ctx, collection, selector)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, removed...)
 	}
+	return lines, nil
+}
 
-	if len(rule) > 0 {
-		line.V0 = rule[0]
-	}
-	if len(rule) > 1 {
-		line.V1 = rule[1]
-	}
-	if len(rule) > 2 {
-		line.V2 = rule[2]
-	}
-	if len(rule) > 3 {
-		line.V3 = rule[3]
+func (a *adapter) removeMatchingFrom(ctx context.Context, collection *mongo.Collection, selector map[string]interface{}) ([]CasbinRule, error) {
+	lines, err := a.findLines(ctx, collection, selector)
+	if err != nil {
+		return nil, err
 	}
-	if len(rule) > 4 {
-		line.V4 = rule[4]
+	if len(lines) == 0 {
+		return nil, nil
 	}
-	if len(rule) > 5 {
-		line.V5 = rule[5]
+	ids := make(bson.A, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.ID)
 	}
 
-	return line
+	if _, err := a.deleteMany(ctx, collection, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+	return lines, nil
 }
 
-// SavePolicy saves policy to database.
-func (a *adapter) SavePolicy(model model.Model) error {
-	if a.filtered {
-		return errors.New("cannot save a filtered policy")
-	}
-	if err := a.dropTable(); err != nil {
-		return err
-	}
+// CountPolicies returns the number of stored rules matching the filter,
+// without loading them, e.g. the rules of a tenant for a dashboard. The filter
+// is a MongoDB selector, or FilterOptions wrapping one, and a nil filter
+// counts every rule.
+func (a *adapter) CountPolicies(ctx context.Context, filter interface{}) (count int64, err error) {
+	defer a.observe("CountPolicies", &err)()
+	defer a.wrapError("CountPolicies", &err)
 
-	var lines []interface{}
+	ctx, span := a.startSpan(ctx, "CountPolicies")
+	defer endSpan(span, &err)
 
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+	countOption := options.Count()
+	if filterOptions, ok := filter.(FilterOptions); ok {
+		filter = filterOptions.Filter
+		if collation := filterOptions.collation(); collation != nil {
+			countOption.SetCollation(collation)
 		}
 	}
-
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
-		}
+	if filter == nil {
+		filter = bson.D{}
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+
+	ctx, cancel := a.timeoutContext(ctx)
 	defer cancel()
 
-	if _, err := a.collection.InsertMany(ctx, lines); err != nil {
-		return err
+	for _, collection := range a.collections() {
+		n, err := collection.CountDocuments(ctx, a.active(filter), countOption)
+		if err != nil {
+			return count, a.commandError("count", collection, err)
+		}
+		count += n
 	}
-
-	return nil
+	span.SetAttributes(rulesAttribute(int(count)))
+	return count, nil
 }
 
-// AddPolicy adds a policy rule to the storage.
-func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
-
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
+// HasPolicy reports whether the rule is stored, without loading the policy.
+// Every value column is stored, even if empty, so the trailing empty values
+// of the rule don't matter: {"alice", "data1", "read", ""} is the same rule as
+// {"alice", "data1", "read"}.
+func (a *adapter) HasPolicy(ctx context.Context, sec string, ptype string, rule []string) (exists bool, err error) {
+	defer a.observe("HasPolicy", &err)()
+	defer a.wrapError("HasPolicy", &err)
 
-	if _, err := a.collection.InsertOne(ctx, line); err != nil {
-		return err
-	}
+	ctx, span := a.startSpan(ctx, "HasPolicy", ptypeAttribute(ptype))
+	defer endSpan(span, &err)
 
-	return nil
-}
+	line := a.policyLine(sec, ptype, rule).selector()
 
-// AddPolicies adds policy rules to the storage.
-func (a *adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
-	var lines []interface{}
-	for _, rule := range rules {
-		line := savePolicyLine(ptype, rule)
-		lines = append(lines, line)
-	}
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.withTimeout(ctx)
 	defer cancel()
-	if _, err := a.collection.InsertMany(ctx, lines); err != nil {
-		return err
+
+	collection := a.collectionFor(&line)
+	n, err := collection.CountDocuments(ctx, a.active(line), options.Count().SetLimit(1))
+	if err != nil {
+		return false, a.commandError("count", collection, err)
 	}
-	return nil
+	return n > 0, nil
 }
 
-// RemovePolicies removes policy rules from the storage.
-func (a *adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
-	var lines []CasbinRule
-	for _, rule := range rules {
-		line := savePolicyLine(ptype, rule)
-		lines = append(lines, line)
-	}
+// CountFilteredForUpdate returns the number of rules UpdateFilteredPolicies
+// would delete and replace for the same arguments, without modifying them.
+func (a *adapter) CountFilteredForUpdate(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) (count int64, err error) {
+	defer a.observe("CountFilteredForUpdate", &err)()
+	defer a.wrapError("CountFilteredForUpdate", &err)
 
-	for _, line := range lines {
-		ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-		defer cancel()
-		if _, err := a.collection.DeleteOne(ctx, line); err != nil {
-			return err
+	ctx, span := a.startSpan(ctx, "CountFilteredForUpdate", ptypeAttribute(ptype))
+	defer endSpan(span, &err)
+
+	selector := a.filteredSelector(sec, ptype, fieldIndex, fieldValues...)
+
+	ctx, cancel := a.timeoutContext(ctx)
+	defer cancel()
+
+	for _, collection := range a.collections() {
+		n, err := collection.CountDocuments(ctx, selector)
+		if err != nil {
+			return count, a.commandError("count", collection, err)
 		}
+		count += n
 	}
-
-	return nil
+	return count, nil
 }
 
-// RemovePolicy removes a policy rule from the storage.
-func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
+// UpdatePolicy updates a policy rule from storage.
+// This is part of the Auto-Save feature.
+func (a *adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []string) (err error) {
+	defer a.observe("UpdatePolicy", &err)()
+	defer a.wrapError("UpdatePolicy", &err)
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
 
-	if _, err := a.collection.DeleteOne(ctx, line); err != nil {
+	oldLine := a.policyLine(sec, ptype, oldRule).selector()
+	newLine := a.policyLine(sec, ptype, newPolicy)
+	if err := a.checkLineSizes(newLine); err != nil {
 		return err
 	}
 
-	return nil
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+	// Updating all the documents equals to replacing
+	if err := a.replaceLine(ctx, oldLine, newLine); err != nil {
+		return err
+	}
+	return a.bumpGeneration(ctx)
 }
 
-// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
-func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
-	selector := make(map[string]interface{})
-	selector["ptype"] = ptype
+// UpdatePolicyByKey replaces the rule of the ptype whose fields at
+// keyFieldIndices equal keyValues with newRule, whatever its other fields,
+// e.g. to change the effect of the rule of a subject, object and action.
+// If several rules match, only one of them is replaced. Nothing is updated
+// if none matches.
+func (a *adapter) UpdatePolicyByKey(ctx context.Context, ptype string, keyFieldIndices []int, keyValues []string, newRule []string) (err error) {
+	defer a.observe("UpdatePolicyByKey", &err)()
+	defer a.wrapError("UpdatePolicyByKey", &err)
 
-	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
-		if fieldValues[0-fieldIndex] != "" {
-			selector["v0"] = fieldValues[0-fieldIndex]
-		}
-	}
-	if fieldIndex <= 1 && 1 < fieldIndex+len(fieldValues) {
-		if fieldValues[1-fieldIndex] != "" {
-			selector["v1"] = fieldValues[1-fieldIndex]
-		}
-	}
-	if fieldIndex <= 2 && 2 < fieldIndex+len(fieldValues) {
-		if fieldValues[2-fieldIndex] != "" {
-			selector["v2"] = fieldValues[2-fieldIndex]
-		}
+	ctx, span := a.startSpan(ctx, "UpdatePolicyByKey", ptypeAttribute(ptype), rulesAttribute(1))
+	defer endSpan(span, &err)
+
+	if err := a.checkWritable(); err != nil {
+		return err
 	}
-	if fieldIndex <= 3 && 3 < fieldIndex+len(fieldValues) {
-		if fieldValues[3-fieldIndex] != "" {
-			selector["v3"] = fieldValues[3-fieldIndex]
-		}
+
+	if len(keyFieldIndices) != len(keyValues) {
+		return fmt.Errorf("key field indices and values %w", ErrLengthMismatch)
 	}
-	if fieldIndex <= 4 && 4 < fieldIndex+len(fieldValues) {
-		if fieldValues[4-fieldIndex] != "" {
-			selector["v4"] = fieldValues[4-fieldIndex]
-		}
+
+	sec := section(ptype)
+	selector := a.filteredSelector(sec, ptype, 0)
+	for i, index := range keyFieldIndices {
+		key := a.fieldNames.field(fmt.Sprintf("v%d", index))
+		selector[key] = a.selectorValue(index, keyValues[i])
 	}
-	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
-		if fieldValues[5-fieldIndex] != "" {
-			selector["v5"] = fieldValues[5-fieldIndex]
-		}
+
+	newLine := a.policyLine(sec, ptype, newRule)
+	if err := a.checkLineSizes(newLine); err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.timeoutContext(ctx)
 	defer cancel()
-
-	if _, err := a.collection.DeleteMany(ctx, selector); err != nil {
+	if err := a.replaceLine(ctx, selector, newLine); err != nil {
 		return err
 	}
-
-	return nil
+	return a.bumpGeneration(ctx)
 }
 
-// UpdatePolicy updates a policy rule from storage.
-// This is part of the Auto-Save feature.
-func (a *adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []string) error {
-	oldLine := savePolicyLine(ptype, oldRule)
-	newLine := savePolicyLine(ptype, newPolicy)
+// UpdatePolicies updates some policy rules to storage, like db, redis. The
+// rules are replaced with a single BulkWrite, in a transaction if the server
+// supports it. With AdapterConfig.ShardCount, they are replaced one by one.
+func (a *adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) (err error) {
+	defer a.observe("UpdatePolicies", &err)()
+	defer a.wrapError("UpdatePolicies", &err)
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
-	// Updating all the documents equals to replacing
-	_, err := a.collection.ReplaceOne(ctx, oldLine, newLine)
-	return err
-}
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	if len(oldRules) != len(newRules) {
+		return fmt.Errorf("oldRules and newRules %w", ErrLengthMismatch)
+	}
 
-// UpdatePolicies updates some policy rules to storage, like db, redis.
-func (a *adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
 	oldLines := make([]CasbinRule, 0, len(oldRules))
 	newLines := make([]CasbinRule, 0, len(oldRules))
 	for _, oldRule := range oldRules {
-		oldLines = append(oldLines, savePolicyLine(ptype, oldRule))
+		oldLines = append(oldLines, a.policyLine(sec, ptype, oldRule).selector())
 	}
 	for _, newRule := range newRules {
-		newLines = append(newLines, savePolicyLine(ptype, newRule))
+		newLines = append(newLines, a.policyLine(sec, ptype, newRule))
+	}
+	if err := a.checkLineSizes(newLines...); err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.timeoutContext(a.baseContext())
 	defer cancel()
-	for i := range oldRules {
-		_, err := a.collection.ReplaceOne(ctx, oldLines[i], newLines[i])
-		if err != nil {
-			return err
+	if len(a.shards) > 0 || a.deterministicID {
+		// A rule may move to another shard, or change its _id.
+		for i := range oldLines {
+			if err := a.replaceLine(ctx, oldLines[i], newLines[i]); err != nil {
+				return err
+			}
 		}
+	} else if err := a.replaceLines(ctx, oldLines, newLines); err != nil {
+		return err
 	}
-	return nil
+	return a.bumpGeneration(ctx)
 }
 
 // UpdateFilteredPolicies deletes old rules and adds new rules.
-func (a *adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
-	selector := make(map[string]interface{})
-	selector["ptype"] = ptype
+func (a *adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) (oldPolicies [][]string, err error) {
+	defer a.observe("UpdateFilteredPolicies", &err)()
+	defer a.wrapError("UpdateFilteredPolicies", &err)
 
-	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
-		if fieldValues[0-fieldIndex] != "" {
-			selector["v0"] = fieldValues[0-fieldIndex]
-		}
-	}
-	if fieldIndex <= 1 && 1 < fieldIndex+len(fieldValues) {
-		if fieldValues[1-fieldIndex] != "" {
-			selector["v1"] = fieldValues[1-fieldIndex]
-		}
-	}
-	if fieldIndex <= 2 && 2 < fieldIndex+len(fieldValues) {
-		if fieldValues[2-fieldIndex] != "" {
-			selector["v2"] = fieldValues[2-fieldIndex]
-		}
-	}
-	if fieldIndex <= 3 && 3 < fieldIndex+len(fieldValues) {
-		if fieldValues[3-fieldIndex] != "" {
-			selector["v3"] = fieldValues[3-fieldIndex]
-		}
-	}
-	if fieldIndex <= 4 && 4 < fieldIndex+len(fieldValues) {
-		if fieldValues[4-fieldIndex] != "" {
-			selector["v4"] = fieldValues[4-fieldIndex]
-		}
-	}
-	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
-		if fieldValues[5-fieldIndex] != "" {
-			selector["v5"] = fieldValues[5-fieldIndex]
-		}
+	return a.replaceFilteredPolicies(sec, ptype, newPolicies, fieldIndex, fieldValues...)
+}
+
+// ReplaceFilteredPolicy replaces the rules matching the filter with newRule,
+// e.g. the single permission of a subject with fieldIndex 0, without knowing
+// the rules it replaces. Like UpdateFilteredPolicies, the rules are replaced
+// in a transaction if the server supports it.
+func (a *adapter) ReplaceFilteredPolicy(sec string, ptype string, newRule []string, fieldIndex int, fieldValues ...string) (err error) {
+	defer a.observe("ReplaceFilteredPolicy", &err)()
+	defer a.wrapError("ReplaceFilteredPolicy", &err)
+
+	_, err = a.replaceFilteredPolicies(sec, ptype, [][]string{newRule}, fieldIndex, fieldValues...)
+	return err
+}
+
+// replaceFilteredPolicies deletes the rules matching the filter, adds the new
+// rules, and returns the deleted rules.
+func (a *adapter) replaceFilteredPolicies(sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) (oldPolicies [][]string, err error) {
+	if err := a.checkWritable(); err != nil {
+		return nil, err
 	}
 
+	selector := a.filteredSelector(sec, ptype, fieldIndex, fieldValues...)
+
 	oldLines := make([]CasbinRule, 0)
 	newLines := make([]CasbinRule, 0, len(newPolicies))
 	for _, newPolicy := range newPolicies {
-		newLines = append(newLines, savePolicyLine(ptype, newPolicy))
+		newLines = append(newLines, a.policyLine(sec, ptype, newPolicy))
+	}
+	if err := a.checkLineSizes(newLines...); err != nil {
+		return nil, err
 	}
 
-	oldPolicies, err := a.updateFilteredPoliciesTxn(oldLines, newLines, selector)
-	if err == nil {
-		return oldPolicies, err
+	oldPolicies, err = a.updateFilteredPoliciesTxn(oldLines, newLines, selector)
+	if err != nil {
+		// (IllegalOperation) Transaction numbers are only allowed on a replica set member or mongos
+		var mongoErr mongo.CommandError
+		if !errors.As(err, &mongoErr) || mongoErr.Code != 20 {
+			return nil, err
+		}
+
+		log.Println("[WARNING]: As your mongodb server doesn't allow a replica set, transaction operation is not supported. So Casbin Adapter will run non-transactional updating!")
+		oldPolicies, err = a.updateFilteredPolicies(oldLines, newLines, selector)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// (IllegalOperation) Transaction numbers are only allowed on a replica set member or mongos
-	if mongoErr, ok := err.(mongo.CommandError); !ok || mongoErr.Code != 20 {
+
+	ctx, cancel := a.timeoutContext(a.baseContext())
+	defer cancel()
+	if err := a.bumpGeneration(ctx); err != nil {
 		return nil, err
 	}
-
-	log.Println("[WARNING]: As your mongodb server doesn't allow a replica set, transaction operation is not supported. So Casbin Adapter will run non-transactional updating!")
-	return a.updateFilteredPolicies(oldLines, newLines, selector)
+	return oldPolicies, nil
 }
 
 func (a *adapter) updateFilteredPoliciesTxn(oldLines, newLines []CasbinRule, selector map[string]interface{}) ([][]string, error) {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.saveContext(a.baseContext())
 	defer cancel()
 
+	// The order is assigned once, rather than on every attempt of the
+	// transaction, which the sequence isn't part of.
+	if err := a.assignOrder(ctx, newLines); err != nil {
+		return nil, err
+	}
+
 	session, err := a.client.StartSession()
 	if err != nil {
 		return nil, err
 	}
-	defer session.EndSession(context.TODO())
+	defer session.EndSession(a.baseContext())
 
-	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
-		// Load old policies
-		cursor, err := a.collection.Find(ctx, selector)
-		if err != nil {
-			_ = session.AbortTransaction(context.Background())
-			return nil, err
-		}
-		for cursor.Next(ctx) {
-			line := CasbinRule{}
-			err := cursor.Decode(&line)
+	result, err := session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		// The driver retries the callback, so the old rules are collected
+		// anew on every attempt.
+		var found []CasbinRule
+		for _, collection := range a.collections() {
+			// Load old policies
+			lines, err := a.findLines(sessionCtx, collection, selector)
 			if err != nil {
-				_ = session.AbortTransaction(context.Background())
+				_ = session.AbortTransaction(a.baseContext())
 				return nil, err
 			}
-			oldLines = append(oldLines, line)
-		}
-		if err = cursor.Close(ctx); err != nil {
-			_ = session.AbortTransaction(context.Background())
-			return nil, err
-		}
+			found = append(found, lines...)
 
-		// Delete all old policies
-		if _, err := a.collection.DeleteMany(sessionCtx, selector); err != nil {
-			_ = session.AbortTransaction(context.Background())
-			return nil, err
+			// Delete all old policies
+			if _, err := a.deleteMany(sessionCtx, collection, selector); err != nil {
+				_ = session.AbortTransaction(a.baseContext())
+				return nil, err
+			}
 		}
 		// Insert new policies
 		for _, newLine := range newLines {
-			if _, err := a.collection.InsertOne(sessionCtx, &newLine); err != nil {
-				_ = session.AbortTransaction(context.Background())
-				return nil, err
+			collection := a.collectionFor(&newLine)
+			if _, err := collection.InsertOne(sessionCtx, &newLine); err != nil {
+				_ = session.AbortTransaction(a.baseContext())
+				return nil, a.commandError("insert", collection, err)
 			}
 		}
-		return nil, nil
+		return found, nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	oldLines = append(oldLines, result.([]CasbinRule)...)
 
 	// return deleted rulues
 	oldPolicies := make([][]string, 0)
@@ -622,34 +5261,30 @@ func (a *adapter) updateFilteredPoliciesTxn(oldLines, newLines []CasbinRule, sel
 }
 
 func (a *adapter) updateFilteredPolicies(oldLines, newLines []CasbinRule, selector map[string]interface{}) ([][]string, error) {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	ctx, cancel := a.saveContext(a.baseContext())
 	defer cancel()
 
-	// Load old policies
-	cursor, err := a.collection.Find(ctx, selector)
-	if err != nil {
-		return nil, err
-	}
-	for cursor.Next(ctx) {
-		line := CasbinRule{}
-		err := cursor.Decode(&line)
+	for _, collection := range a.collections() {
+		// Load old policies
+		lines, err := a.findLines(ctx, collection, selector)
 		if err != nil {
 			return nil, err
 		}
-		oldLines = append(oldLines, line)
-	}
-	if err = cursor.Close(ctx); err != nil {
-		return nil, err
-	}
+		oldLines = append(oldLines, lines...)
 
-	// Delete all old policies
-	if _, err := a.collection.DeleteMany(ctx, selector); err != nil {
-		return nil, err
+		// Delete all old policies
+		if _, err := a.deleteMany(ctx, collection, selector); err != nil {
+			return nil, err
+		}
 	}
 	// Insert new policies
+	if err := a.assignOrder(ctx, newLines); err != nil {
+		return nil, err
+	}
 	for _, newLine := range newLines {
-		if _, err := a.collection.InsertOne(ctx, &newLine); err != nil {
-			return nil, err
+		collection := a.collectionFor(&newLine)
+		if _, err := collection.InsertOne(ctx, &newLine); err != nil {
+			return nil, a.commandError("insert", collection, err)
 		}
 	}
 
@@ -662,6 +5297,30 @@ func (a *adapter) updateFilteredPolicies(oldLines, newLines []CasbinRule, select
 	return oldPolicies, nil
 }
 
+// rule returns the values of the rule, without the trailing empty ones.
+func (c *CasbinRule) rule() []string {
+	rule := append([]string{c.V0, c.V1, c.V2, c.V3, c.V4, c.V5}, c.Extra...)
+	for len(rule) > 0 && rule[len(rule)-1] == "" {
+		rule = rule[:len(rule)-1]
+	}
+	return rule
+}
+
+// trimSpace trims the leading and trailing whitespace of the values.
+func (c *CasbinRule) trimSpace() {
+	for _, v := range []*string{&c.V0, &c.V1, &c.V2, &c.V3, &c.V4, &c.V5} {
+		*v = strings.TrimSpace(*v)
+	}
+	for i := range c.Extra {
+		c.Extra[i] = strings.TrimSpace(c.Extra[i])
+	}
+}
+
+// key returns a string that identifies the rule by all of its fields.
+func (c *CasbinRule) key() string {
+	return strings.Join(append([]string{c.Sec, c.PType}, c.rule()...), "\x00")
+}
+
 func (c *CasbinRule) toStringPolicy() []string {
 	policy := make([]string, 0)
 	if c.PType != "" {
@@ -685,5 +5344,10 @@ func (c *CasbinRule) toStringPolicy() []string {
 	if c.V5 != "" {
 		policy = append(policy, c.V5)
 	}
+	for _, v := range c.Extra {
+		if v != "" {
+			policy = append(policy, v)
+		}
+	}
 	return policy
 }
@@ -0,0 +1,183 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// memoryAdapter stores the policy in memory, as the rules the MongoDB adapter
+// would store with the default configuration.
+type memoryAdapter struct {
+	mu    sync.Mutex
+	lines []CasbinRule
+}
+
+// NewInMemoryAdapter returns an adapter storing the policy in memory, e.g. to
+// unit test an authorization logic without a MongoDB server. It converts the
+// rules like the adapters of NewAdapter do with the default configuration:
+// adding a rule already stored fails, the rules are loaded in the order they
+// were added, and the filters of RemoveFilteredPolicy match the same rules.
+func NewInMemoryAdapter() persist.BatchAdapter {
+	return &memoryAdapter{}
+}
+
+// LoadPolicy loads all the stored rules into the model.
+func (a *memoryAdapter) LoadPolicy(model model.Model) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, line := range a.lines {
+		if err := loadPolicyLine(line, model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePolicy replaces the stored rules with the rules of the model.
+func (a *memoryAdapter) SavePolicy(model model.Model) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lines = nil
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				if err := a.add(ptype, rule); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AddPolicy adds a policy rule to the storage.
+func (a *memoryAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.add(ptype, rule)
+}
+
+// AddPolicies adds policy rules to the storage. A duplicate rule aborts the
+// call, but the rules preceding it remain added.
+func (a *memoryAdapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, rule := range rules {
+		if err := a.add(ptype, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add stores the rule, unless it's already stored.
+func (a *memoryAdapter) add(ptype string, rule []string) error {
+	line := savePolicyLine(ptype, rule)
+	if a.index(&line) >= 0 {
+		return fmt.Errorf("rule already stored: %s %v", ptype, rule)
+	}
+	a.lines = append(a.lines, line)
+	return nil
+}
+
+// index returns the index of the stored line with the same values, or -1.
+func (a *memoryAdapter) index(line *CasbinRule) int {
+	key := line.key()
+	for i := range a.lines {
+		if a.lines[i].key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemovePolicy removes a policy rule from the storage.
+func (a *memoryAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.remove(ptype, rule)
+	return nil
+}
+
+// RemovePolicies removes policy rules from the storage.
+func (a *memoryAdapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, rule := range rules {
+		a.remove(ptype, rule)
+	}
+	return nil
+}
+
+// remove deletes the stored rule, if any.
+func (a *memoryAdapter) remove(ptype string, rule []string) {
+	line := savePolicyLine(ptype, rule)
+	if i := a.index(&line); i >= 0 {
+		a.lines = append(a.lines[:i], a.lines[i+1:]...)
+	}
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
+// Empty field values match any value, and EmptyValue only empty values.
+func (a *memoryAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kept := a.lines[:0]
+	for _, line := range a.lines {
+		if !matchesFilter(line, ptype, fieldIndex, fieldValues) {
+			kept = append(kept, line)
+		}
+	}
+	a.lines = kept
+	return nil
+}
+
+// matchesFilter reports whether the line matches the selector
+// filteredSelector builds from the same arguments.
+func matchesFilter(line CasbinRule, ptype string, fieldIndex int, fieldValues []string) bool {
+	if line.PType != ptype {
+		return false
+	}
+	rule := line.rule()
+	for i, value := range fieldValues {
+		index := fieldIndex + i
+		if index < 0 || value == "" {
+			continue
+		}
+		stored := ""
+		if index < len(rule) {
+			stored = rule[index]
+		}
+		if value == EmptyValue {
+			value = ""
+		}
+		if stored != value {
+			return false
+		}
+	}
+	return true
+}
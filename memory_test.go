@@ -0,0 +1,176 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func newInMemoryEnforcer(t *testing.T) *casbin.Enforcer {
+	t.Helper()
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err != nil {
+		panic(err)
+	}
+	a := NewInMemoryAdapter()
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		panic(err)
+	}
+
+	e, err = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func TestInMemoryAdapter(t *testing.T) {
+	e := newInMemoryEnforcer(t)
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+	},
+	)
+
+	e.EnableAutoSave(false)
+	e.AddPolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+	},
+	)
+
+	e.EnableAutoSave(true)
+	e.AddPolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+		{"alice", "data1", "write"},
+	},
+	)
+
+	// Like the unique index, the adapter rejects a rule already stored.
+	if err := e.GetAdapter().AddPolicy("p", "p", []string{"alice", "data1", "write"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a rule already stored")
+	}
+
+	e.RemovePolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+	},
+	)
+
+	e.RemoveFilteredPolicy(0, "data2_admin")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+	},
+	)
+
+	e.RemoveFilteredPolicy(1, "data1")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}})
+
+	e.RemoveFilteredPolicy(2, "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{})
+}
+
+func TestInMemoryAdapterBatch(t *testing.T) {
+	e := newInMemoryEnforcer(t)
+
+	if _, err := e.AddPolicies([][]string{{"jack", "data4", "read"}, {"jack", "data4", "write"}}); err != nil {
+		t.Errorf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+		{"jack", "data4", "read"},
+		{"jack", "data4", "write"},
+	},
+	)
+
+	if _, err := e.RemovePolicies([][]string{{"jack", "data4", "read"}, {"jack", "data4", "write"}}); err != nil {
+		t.Errorf("Expected RemovePolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+	},
+	)
+
+	// EmptyValue only matches the rules without the value.
+	a := e.GetAdapter()
+	if err := a.AddPolicy("p", "p", []string{"carol", "", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 1, EmptyValue); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"},
+		{"bob", "data2", "write"},
+		{"data2_admin", "data2", "read"},
+		{"data2_admin", "data2", "write"},
+	},
+	)
+
+	if !e.HasGroupingPolicy("alice", "data2_admin") {
+		t.Error("Expected the grouping policy to be loaded")
+	}
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected alice to read data2 through her role")
+	}
+}